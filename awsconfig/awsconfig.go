@@ -0,0 +1,96 @@
+package awsconfig
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	// defaultRoleSessionName is the session name used when assuming a role without RoleSessionName
+	defaultRoleSessionName = "aws-sqsd"
+
+	// roleExpiryWindow is the time before expiry assumed role credentials are refreshed
+	roleExpiryWindow = time.Minute
+)
+
+// Config are the AWS settings used for the SQS and SNS clients, empty settings use the
+// defaults of the AWS SDK, which reads the environment variables and the shared config files
+type Config struct {
+	// Endpoint is the URL used instead of the AWS endpoints, like http://localhost:4566 for a LocalStack-style stand-in
+	Endpoint string
+	Region   string
+	// Profile is the named profile from the shared credentials and config files
+	Profile string
+	// PathStyle forces path-style addressing (http://endpoint/bucket) for services that also support
+	// virtual hosted-style addressing, required by some local stand-ins. SQS and SNS always use the endpoint as is.
+	PathStyle bool
+
+	// RoleARN is a role that is assumed for all API calls, for example to use a queue in another account.
+	// ExternalID and RoleSessionName are used when assuming the role.
+	// The temporary credentials are refreshed automatically before they expire.
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+
+	// STSEndpoint is the URL of the STS API used to assume roles, Endpoint is not used for STS.
+	// Empty uses the AWS endpoint of the region.
+	STSEndpoint string
+}
+
+// NewSession returns an AWS session using these settings
+func (c *Config) NewSession() (*session.Session, error) {
+	opts := session.Options{
+		Profile: c.Profile,
+		Config:  *c.AWSConfig(),
+	}
+	if c.Profile != "" {
+		// the region of a named profile is only read from the shared config file when it is enabled
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AWS session (check environment variables): %s", err)
+	}
+
+	if c.RoleARN != "" {
+		sess = sess.Copy(&aws.Config{Credentials: c.AssumeRole(sess, c.RoleARN)})
+	}
+	return sess, nil
+}
+
+// AssumeRole returns credentials of roleARN, assumed using the credentials of sess with ExternalID and RoleSessionName.
+// The role is assumed at STSEndpoint, the endpoint of sess is the one of SQS and SNS.
+func (c *Config) AssumeRole(sess *session.Session, roleARN string) *credentials.Credentials {
+	stsSess := sess.Copy(&aws.Config{Endpoint: aws.String(c.STSEndpoint)})
+	return stscreds.NewCredentials(stsSess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = c.RoleSessionName
+		if p.RoleSessionName == "" {
+			p.RoleSessionName = defaultRoleSessionName
+		}
+		if c.ExternalID != "" {
+			p.ExternalID = aws.String(c.ExternalID)
+		}
+		p.ExpiryWindow = roleExpiryWindow
+	})
+}
+
+// AWSConfig returns the aws.Config with the endpoint, region and path-style settings
+func (c *Config) AWSConfig() *aws.Config {
+	cfg := aws.NewConfig()
+	if c.Endpoint != "" {
+		cfg.WithEndpoint(c.Endpoint)
+	}
+	if c.Region != "" {
+		cfg.WithRegion(c.Region)
+	}
+	if c.PathStyle {
+		cfg.WithS3ForcePathStyle(true)
+	}
+	return cfg
+}
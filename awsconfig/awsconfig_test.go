@@ -0,0 +1,90 @@
+package awsconfig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASSUMED</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+// recorder is an HTTP server that records the Action of the requests it receives
+type recorder struct {
+	*httptest.Server
+	mu      sync.Mutex
+	actions []string
+}
+
+func newRecorder(response string) *recorder {
+	r := new(recorder)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.actions = append(r.actions, req.URL.Query().Get("Action")+string(b))
+		r.mu.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(response))
+	}))
+	return r
+}
+
+func (r *recorder) requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.actions...)
+}
+
+func TestAssumeRoleDoesNotUseEndpoint(t *testing.T) {
+	sqsEndpoint := newRecorder("")
+	defer sqsEndpoint.Close()
+	stsEndpoint := newRecorder(assumeRoleResponse)
+	defer stsEndpoint.Close()
+
+	c := &Config{
+		Endpoint:    sqsEndpoint.URL,
+		Region:      "eu-west-1",
+		RoleARN:     "arn:aws:iam::123456789012:role/worker",
+		STSEndpoint: stsEndpoint.URL,
+	}
+	sess, err := session.NewSession(c.AWSConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "secret", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := c.AssumeRole(sess, c.RoleARN).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ASSUMED" {
+		t.Errorf("got access key %s, want the assumed role credentials", creds.AccessKeyID)
+	}
+
+	if got := sqsEndpoint.requests(); len(got) != 0 {
+		t.Errorf("the SQS endpoint received %d requests: %v", len(got), got)
+	}
+	got := stsEndpoint.requests()
+	if len(got) != 1 || !strings.Contains(got[0], "Action=AssumeRole") {
+		t.Errorf("the STS endpoint received %v, want a single AssumeRole request", got)
+	}
+
+	// the session itself still uses Endpoint
+	if endpoint := aws.StringValue(sess.Config.Endpoint); endpoint != sqsEndpoint.URL {
+		t.Errorf("the session endpoint is %s, want %s", endpoint, sqsEndpoint.URL)
+	}
+}
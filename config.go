@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/internal/yaml"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/sqsd"
+)
+
+// option is a setting that can be set with a flag, an environment variable or in the config file.
+// Flags take precedence over environment variables, which take precedence over the config file.
+type option struct {
+	// name is the key in the config file, the aws:elasticbeanstalk:sqsd option name where there is one
+	name string
+	flag string
+	env  string
+	// legacyEnv is the environment variable used before env existed
+	legacyEnv string
+	check     func(value string) error
+}
+
+var options = []option{
+	{name: "WorkerQueueURL", flag: "sqs-url", env: "SQSD_WORKER_QUEUE_URL", legacyEnv: "SQS_URL", check: checkURL},
+	{name: "CreateQueue", flag: "sqs-create-queue", env: "SQSD_CREATE_QUEUE", legacyEnv: "SQS_CREATE_QUEUE"},
+	{name: "SNSTopicARNs", flag: "subscribe-to-sns-arns", env: "SQSD_SNS_TOPIC_ARNS"},
+	{name: "SourceDir", flag: "source-dir", env: "SQSD_SOURCE_DIR"},
+	{name: "Local", flag: "local", env: "SQSD_LOCAL"},
+	{name: "LocalAddr", flag: "local-addr", env: "SQSD_LOCAL_ADDR"},
+	{name: "LocalSQSAddr", flag: "local-sqs-addr", env: "SQSD_LOCAL_SQS_ADDR"},
+	{name: "HttpURL", flag: "http-url", env: "SQSD_HTTP_URL", check: checkURL},
+	{name: "HttpPath", flag: "http-path", env: "SQSD_HTTP_PATH", check: checkPath},
+	{name: "MimeType", flag: "mime-type", env: "SQSD_MIME_TYPE", check: checkNotEmpty},
+	{name: "HttpConnections", flag: "connections", env: "SQSD_HTTP_CONNECTIONS", check: checkRange(1, 10000)},
+	{name: "ConnectTimeout", flag: "connect-timeout", env: "SQSD_CONNECT_TIMEOUT", check: checkRange(0, 60)},
+	{name: "InactivityTimeout", flag: "http-timeout", env: "SQSD_INACTIVITY_TIMEOUT", check: checkRange(1, 36000)},
+	{name: "VisibilityTimeout", flag: "visibility-timeout", env: "SQSD_VISIBILITY_TIMEOUT", check: checkRange(0, 43200)},
+	{name: "MaxJobDuration", flag: "max-job-duration", env: "SQSD_MAX_JOB_DURATION", check: checkRange(0, 43200)},
+	{name: "Pollers", flag: "pollers", env: "SQSD_POLLERS"},
+	{name: "CronFile", flag: "cron-file", env: "SQSD_CRON_FILE"},
+	{name: "HttpSuccessCodes", flag: "http-success-codes", env: "SQSD_HTTP_SUCCESS_CODES", check: checkSuccessCodes},
+	{name: "HttpPermanentFailureCodes", flag: "http-permanent-failure-codes", env: "SQSD_HTTP_PERMANENT_FAILURE_CODES", check: checkStatusCodes},
+	{name: "HttpRetryableCodes", flag: "http-retryable-codes", env: "SQSD_HTTP_RETRYABLE_CODES", check: checkStatusCodes},
+	{name: "HttpBackpressureCodes", flag: "http-backpressure-codes", env: "SQSD_HTTP_BACKPRESSURE_CODES", check: checkStatusCodes},
+	{name: "BackpressureDelay", flag: "backpressure-delay", env: "SQSD_BACKPRESSURE_DELAY", check: checkRange(1, 43200)},
+	{name: "CircuitBreakerThreshold", flag: "circuit-breaker-threshold", env: "SQSD_CIRCUIT_BREAKER_THRESHOLD", check: checkRange(0, 10000)},
+	{name: "CircuitBreakerTimeout", flag: "circuit-breaker-timeout", env: "SQSD_CIRCUIT_BREAKER_TIMEOUT", check: checkRange(1, 3600)},
+	{name: "HealthCheckURL", flag: "health-check-url", env: "SQSD_HEALTH_CHECK_URL", check: checkURL},
+	{name: "HealthCheckAddr", flag: "health-check-addr", env: "SQSD_HEALTH_CHECK_ADDR", check: checkAddr},
+	{name: "HealthCheckTimeout", flag: "health-check-timeout", env: "SQSD_HEALTH_CHECK_TIMEOUT", check: checkRange(0, 86400)},
+	{name: "HealthCheckInterval", flag: "health-check-interval", env: "SQSD_HEALTH_CHECK_INTERVAL", check: checkRange(0, 3600)},
+	{name: "ErrorVisibilityTimeout", flag: "error-visibility-timeout", env: "SQSD_ERROR_VISIBILITY_TIMEOUT", check: checkRange(0, 43200)},
+	{name: "ErrorVisibilityBackoff", flag: "error-visibility-backoff", env: "SQSD_ERROR_VISIBILITY_BACKOFF"},
+	{name: "RetentionPeriod", flag: "retention-period", env: "SQSD_RETENTION_PERIOD", check: checkRetentionPeriod},
+	{name: "MaxRetries", flag: "max-retries", env: "SQSD_MAX_RETRIES", check: checkRange(0, 1000)},
+	{name: "DeadLetterQueueURL", flag: "dead-letter-queue-url", env: "SQSD_DEAD_LETTER_QUEUE_URL", check: checkURL},
+	{name: "CreateDeadLetterQueue", flag: "sqs-create-dead-letter-queue", env: "SQSD_CREATE_DEAD_LETTER_QUEUE"},
+	{name: "CreateFIFOQueue", flag: "sqs-create-fifo-queue", env: "SQSD_CREATE_FIFO_QUEUE"},
+	{name: "ContentBasedDeduplication", flag: "sqs-content-based-deduplication", env: "SQSD_CONTENT_BASED_DEDUPLICATION"},
+	{name: "LeaderQueueURL", flag: "leader-queue-url", env: "SQSD_LEADER_QUEUE_URL", check: checkLeaderQueueURL},
+	{name: "ShutdownTimeout", flag: "shutdown-timeout", env: "SQSD_SHUTDOWN_TIMEOUT"},
+	{name: "AWSEndpoint", flag: "aws-endpoint", env: "SQSD_AWS_ENDPOINT", check: checkURL},
+	{name: "AWSRegion", flag: "aws-region", env: "SQSD_AWS_REGION"},
+	{name: "AWSProfile", flag: "aws-profile", env: "SQSD_AWS_PROFILE"},
+	{name: "AWSPathStyle", flag: "aws-path-style", env: "SQSD_AWS_PATH_STYLE"},
+	{name: "AWSRoleARN", flag: "aws-role-arn", env: "SQSD_AWS_ROLE_ARN"},
+	{name: "AWSExternalID", flag: "aws-external-id", env: "SQSD_AWS_EXTERNAL_ID"},
+	{name: "AWSRoleSessionName", flag: "aws-role-session-name", env: "SQSD_AWS_ROLE_SESSION_NAME"},
+	{name: "AWSSTSEndpoint", flag: "aws-sts-endpoint", env: "SQSD_AWS_STS_ENDPOINT", check: checkURL},
+	{name: "SNSRoleARNs", flag: "sns-role-arns", env: "SQSD_SNS_ROLE_ARNS"},
+	{name: "AdminAddr", flag: "admin-addr", env: "SQSD_ADMIN_ADDR"},
+	{name: "LogFormat", flag: "log-format", env: "SQSD_LOG_FORMAT", check: checkLogFormat},
+	{name: "LogLevel", flag: "log-level", env: "SQSD_LOG_LEVEL", check: checkLogLevel},
+	{name: "Verbose", flag: "v", env: "SQSD_VERBOSE"},
+}
+
+// configValues are the option values read from files by option name
+type configValues map[string]configValue
+
+type configValue struct {
+	value string
+	file  string
+}
+
+// loadConfig sets the flags that are not set on the commandline from the environment and then from files,
+// the first files take precedence. It returns where the value of each flag came from.
+func loadConfig(fs *flag.FlagSet, files ...configValues) (map[string]string, error) {
+	sources := make(map[string]string, len(options))
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "set by flag"
+	})
+
+	for _, opt := range options {
+		if sources[opt.flag] != "" {
+			continue
+		}
+
+		value, source, ok := "", "", false
+		for _, env := range []string{opt.env, opt.legacyEnv} {
+			if env == "" {
+				continue
+			}
+			// empty variables are ignored like unset ones, so they do not override config files
+			if value = os.Getenv(env); value != "" {
+				ok, source = true, "set by env "+env
+				break
+			}
+		}
+		for i := 0; !ok && i < len(files); i++ {
+			var v configValue
+			if v, ok = files[i][opt.name]; ok {
+				value, source = v.value, "set in "+v.file
+			}
+		}
+		if !ok {
+			sources[opt.flag] = "default"
+			continue
+		}
+
+		if err := fs.Set(opt.flag, value); err != nil {
+			return nil, fmt.Errorf("invalid %s (%s): %s", opt.name, source, err)
+		}
+		sources[opt.flag] = source
+	}
+	return sources, nil
+}
+
+// readConfigFile reads a YAML or JSON file with option names as keys, lists are joined with commas
+func readConfigFile(file string) (configValues, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", file, err)
+	}
+
+	values := make(configValues, len(raw))
+	for key, val := range raw {
+		opt := lookupOption(key)
+		if opt == nil {
+			return nil, fmt.Errorf("unknown setting %s in config file %s", key, file)
+		}
+		value, err := rawValue(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in config file %s: %s", key, file, err)
+		}
+		values[opt.name] = configValue{value: value, file: file}
+	}
+	return values, nil
+}
+
+// lookupOption returns the option with name, ignoring case
+func lookupOption(name string) *option {
+	for i := range options {
+		if strings.EqualFold(options[i].name, name) {
+			return &options[i]
+		}
+	}
+	return nil
+}
+
+// rawValue returns the flag value of a string, number, bool or list of those
+func rawValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(string(raw)))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("expected a list of strings")
+			}
+			list[i] = s
+		}
+		return strings.Join(list, ","), nil
+	}
+	return "", fmt.Errorf("expected a string, number, boolean or list")
+}
+
+// validateConfig checks the values of all options and the combinations of settings
+func validateConfig(fs *flag.FlagSet) []error {
+	get := func(name string) string {
+		return fs.Lookup(name).Value.String()
+	}
+	set := func(name string) bool {
+		v := get(name)
+		return v != "" && v != "0" && v != "false"
+	}
+
+	var errs []error
+	for _, opt := range options {
+		value := get(opt.flag)
+		if opt.check == nil {
+			continue
+		}
+		if err := opt.check(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s (-%s) %q: %s", opt.name, opt.flag, value, err))
+		}
+	}
+
+	var queues []string
+	for _, name := range []string{"sqs-url", "sqs-create-queue", "source-dir", "local"} {
+		if set(name) {
+			queues = append(queues, name)
+		}
+	}
+	switch len(queues) {
+	case 0:
+		errs = append(errs, fmt.Errorf("one of WorkerQueueURL (-sqs-url), CreateQueue (-sqs-create-queue), SourceDir (-source-dir) or Local (-local) is required"))
+	case 1:
+	default:
+		errs = append(errs, fmt.Errorf("only one of -%s can be used", strings.Join(queues, ", -")))
+	}
+
+	if set("sqs-create-dead-letter-queue") && !set("sqs-create-queue") {
+		errs = append(errs, fmt.Errorf("CreateDeadLetterQueue (-sqs-create-dead-letter-queue) can only be used together with CreateQueue (-sqs-create-queue)"))
+	}
+	if set("sqs-create-fifo-queue") && !set("sqs-create-queue") {
+		errs = append(errs, fmt.Errorf("CreateFIFOQueue (-sqs-create-fifo-queue) can only be used together with CreateQueue (-sqs-create-queue)"))
+	}
+	if set("sqs-content-based-deduplication") && !set("sqs-create-fifo-queue") {
+		errs = append(errs, fmt.Errorf("ContentBasedDeduplication (-sqs-content-based-deduplication) can only be used together with CreateFIFOQueue (-sqs-create-fifo-queue)"))
+	}
+	if set("health-check-url") && set("health-check-addr") {
+		errs = append(errs, fmt.Errorf("only one of HealthCheckURL (-health-check-url) or HealthCheckAddr (-health-check-addr) can be used"))
+	}
+	if set("max-job-duration") {
+		if vt, _ := strconv.Atoi(get("visibility-timeout")); vt < 2 {
+			errs = append(errs, fmt.Errorf("a VisibilityTimeout (-visibility-timeout) of at least 2 seconds is required when using MaxJobDuration (-max-job-duration)"))
+		}
+	}
+	if set("max-retries") && !set("dead-letter-queue-url") && !set("sqs-create-dead-letter-queue") && !set("local") {
+		errs = append(errs, fmt.Errorf("MaxRetries (-max-retries) requires DeadLetterQueueURL (-dead-letter-queue-url) or CreateDeadLetterQueue (-sqs-create-dead-letter-queue)"))
+	}
+	return errs
+}
+
+// printConfig writes the effective configuration in the config file format, with the source of each value as comment
+func printConfig(w io.Writer, fs *flag.FlagSet, sources map[string]string) {
+	fmt.Fprintln(w, "# effective configuration, flags take precedence over environment variables and the config file")
+	for _, opt := range options {
+		value := fs.Lookup(opt.flag).Value.String()
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil && value != "true" && value != "false" {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(w, "\n# %s, flag -%s, env %s\n%s: %s\n", sources[opt.flag], opt.flag, opt.env, opt.name, value)
+	}
+}
+
+func checkURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func checkLeaderQueueURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	if err := checkURL(value); err != nil {
+		return err
+	}
+	return sqsd.ValidateLeaderQueueURL(value)
+}
+
+func checkPath(value string) error {
+	if value != "" && !strings.HasPrefix(value, "/") {
+		return fmt.Errorf("must start with /")
+	}
+	return nil
+}
+
+func checkNotEmpty(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+// checkRange returns a check for numbers from min to max
+func checkRange(min, max int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return fmt.Errorf("must be a number from %d to %d", min, max)
+		}
+		return nil
+	}
+}
+
+// checkRetentionPeriod allows 0 or the retention periods SQS supports, 60 seconds to 14 days
+func checkRetentionPeriod(value string) error {
+	if value == "0" {
+		return nil
+	}
+	if err := checkRange(60, 1209600)(value); err != nil {
+		return fmt.Errorf("must be 0 or a number from 60 to 1209600")
+	}
+	return nil
+}
+
+func checkAddr(value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(value); err != nil || port == "" {
+		return fmt.Errorf("must be a host and port like localhost:8080")
+	}
+	return nil
+}
+
+func checkStatusCodes(value string) error {
+	_, err := sqsd.ParseStatusCodes(value)
+	return err
+}
+
+func checkSuccessCodes(value string) error {
+	if err := checkNotEmpty(value); err != nil {
+		return err
+	}
+	return checkStatusCodes(value)
+}
+
+func checkLogFormat(value string) error {
+	_, err := logging.ParseFormat(value)
+	return err
+}
+
+func checkLogLevel(value string) error {
+	_, err := logging.ParseLevel(value)
+	return err
+}
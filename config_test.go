@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestFlagSet returns a flag set with a string flag for every option, connections is an int
+func newTestFlagSet(args ...string) (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	for _, opt := range options {
+		if opt.flag == "connections" {
+			fs.Int(opt.flag, 50, "")
+			continue
+		}
+		fs.String(opt.flag, "", "")
+	}
+	return fs, fs.Parse(args)
+}
+
+// clearEnv unsets the environment variables of all options, they are restored when the test ends
+func clearEnv(t *testing.T) {
+	for _, opt := range options {
+		for _, env := range []string{opt.env, opt.legacyEnv} {
+			if env != "" {
+				t.Setenv(env, "")
+				os.Unsetenv(env)
+			}
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("SQSD_HTTP_URL", "http://env")
+	t.Setenv("SQSD_MIME_TYPE", "text/env")
+	t.Setenv("SQS_URL", "https://legacy-env")
+	t.Setenv("SQSD_HTTP_PATH", "")
+
+	first := configValues{
+		"HttpPath":        {value: "/first", file: "first.yaml"},
+		"MimeType":        {value: "text/first", file: "first.yaml"},
+		"HttpConnections": {value: "10", file: "first.yaml"},
+		"WorkerQueueURL":  {value: "https://first", file: "first.yaml"},
+	}
+	second := configValues{
+		"HttpConnections": {value: "20", file: "second.yaml"},
+		"Pollers":         {value: "3", file: "second.yaml"},
+	}
+
+	fs, err := newTestFlagSet("-http-url", "http://flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err := loadConfig(fs, first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flag, value, source string
+	}{
+		{"http-url", "http://flag", "set by flag"},
+		{"mime-type", "text/env", "set by env SQSD_MIME_TYPE"},
+		{"sqs-url", "https://legacy-env", "set by env SQS_URL"},
+		{"http-path", "/first", "set in first.yaml"},
+		{"connections", "10", "set in first.yaml"},
+		{"pollers", "3", "set in second.yaml"},
+		{"cron-file", "", "default"},
+	}
+	for _, test := range tests {
+		if value := fs.Lookup(test.flag).Value.String(); value != test.value {
+			t.Errorf("-%s is %q, want %q", test.flag, value, test.value)
+		}
+		if source := sources[test.flag]; source != test.source {
+			t.Errorf("-%s is %s, want %s", test.flag, source, test.source)
+		}
+	}
+}
+
+func TestLoadConfigEnvOverridesLegacyEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("SQS_URL", "https://legacy-env")
+	t.Setenv("SQSD_WORKER_QUEUE_URL", "https://env")
+
+	fs, err := newTestFlagSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err := loadConfig(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := fs.Lookup("sqs-url").Value.String(); value != "https://env" || sources["sqs-url"] != "set by env SQSD_WORKER_QUEUE_URL" {
+		t.Errorf("-sqs-url is %q %s, want the value of SQSD_WORKER_QUEUE_URL", value, sources["sqs-url"])
+	}
+}
+
+func TestLoadConfigInvalidValue(t *testing.T) {
+	clearEnv(t)
+
+	fs, err := newTestFlagSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig(fs, configValues{"HttpConnections": {value: "many", file: "sqsd.yaml"}})
+	if err == nil || !strings.Contains(err.Error(), "invalid HttpConnections (set in sqsd.yaml)") {
+		t.Errorf("got error %v, want an invalid HttpConnections error", err)
+	}
+
+	t.Setenv("SQSD_HTTP_CONNECTIONS", "many")
+	_, err = loadConfig(fs)
+	if err == nil || !strings.Contains(err.Error(), "invalid HttpConnections (set by env SQSD_HTTP_CONNECTIONS)") {
+		t.Errorf("got error %v, want an invalid HttpConnections error", err)
+	}
+}
+
+func TestLoadConfigIgnoresEmptyEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("SQSD_HTTP_CONNECTIONS", "")
+	t.Setenv("SQSD_MIME_TYPE", "")
+
+	fs, err := newTestFlagSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err := loadConfig(fs, configValues{"MimeType": {value: "text/file", file: "sqsd.yaml"}})
+	if err != nil {
+		t.Fatalf("empty environment variables are not ignored: %s", err)
+	}
+	if value := fs.Lookup("connections").Value.String(); value != "50" || sources["connections"] != "default" {
+		t.Errorf("-connections is %q %s, want the default", value, sources["connections"])
+	}
+	if value := fs.Lookup("mime-type").Value.String(); value != "text/file" || sources["mime-type"] != "set in sqsd.yaml" {
+		t.Errorf("-mime-type is %q %s, want the value of the config file", value, sources["mime-type"])
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		in   string
+		want map[string]string // nil when an error is expected
+	}{
+		{
+			name: "YAML",
+			in:   "WorkerQueueURL: https://queue\nhttpconnections: 10\nLocal: true\nSNSTopicARNs:\n  - arn:a\n  - arn:b\n",
+			want: map[string]string{"WorkerQueueURL": "https://queue", "HttpConnections": "10", "Local": "true", "SNSTopicARNs": "arn:a,arn:b"},
+		},
+		{
+			name: "JSON",
+			in:   `{"HttpPath": "/worker", "Pollers": 2}`,
+			want: map[string]string{"HttpPath": "/worker", "Pollers": "2"},
+		},
+		{name: "unknown setting", in: "HttpPort: 80\n"},
+		{name: "mapping value", in: "HttpPath: {a: b}\n"},
+		{name: "list of numbers", in: "SNSTopicARNs: [1, 2]\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, "sqsd.yaml")
+			if err := ioutil.WriteFile(file, []byte(test.in), 0644); err != nil {
+				t.Fatal(err)
+			}
+			values, err := readConfigFile(file)
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != len(test.want) {
+				t.Errorf("got %d values, want %d", len(values), len(test.want))
+			}
+			for name, want := range test.want {
+				if v := values[name]; v.value != want || v.file != file {
+					t.Errorf("%s is %q from %s, want %q", name, v.value, v.file, want)
+				}
+			}
+		})
+	}
+}
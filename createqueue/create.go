@@ -2,11 +2,12 @@ package createqueue
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/awsconfig"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -19,14 +20,41 @@ type CreateOptions struct {
 	QueueName         string
 	SNSTopicARNs      []string
 	VisibilityTimeout int
-	Verbose           bool
+
+	// Logger receives the log entries, when it is nil they are written as text to stderr.
+	// Verbose enables the debug entries of that default logger.
+	Logger  logging.Logger
+	Verbose bool
+
+	// AWS are the settings of the SQS and SNS clients
+	AWS awsconfig.Config
+
+	// SNSRoleARNs are roles assumed to subscribe to SNS topics in other accounts, the role in the
+	// account of a topic is used for that topic with the ExternalID and RoleSessionName of AWS
+	SNSRoleARNs []string
+
+	// DeadLetterQueueName creates a dead-letter queue (or uses the existing queue with this name)
+	// and stores its URL in DeadLetterQueueURL. When MaxReceiveCount is set a newly created queue
+	// gets a RedrivePolicy to this dead-letter queue.
+	DeadLetterQueueName string
+	MaxReceiveCount     int
+	DeadLetterQueueURL  string
+
+	// FIFO creates FIFO queues, .fifo is added to QueueName and DeadLetterQueueName when missing.
+	// ContentBasedDeduplication uses a hash of the body as deduplication id of messages sent without one.
+	FIFO                      bool
+	ContentBasedDeduplication bool
 }
 
-func (opts *CreateOptions) logf(msg string, args ...interface{}) {
-	if !opts.Verbose {
-		return
+// fifoSuffix is the suffix of FIFO queue names
+const fifoSuffix = ".fifo"
+
+// log returns Logger, or the default logger when it is nil
+func (opts *CreateOptions) log() logging.Logger {
+	if opts.Logger == nil {
+		opts.Logger = logging.Default(opts.Verbose)
 	}
-	log.Printf(msg, args...)
+	return opts.Logger
 }
 
 // CreateAndSubscribe creates the SQS queue and subscribes it to the SNS topics
@@ -34,63 +62,51 @@ func CreateAndSubscribe(opts *CreateOptions) (string, error) {
 
 	sqsQueueURL := ""
 
-	opts.logf("Creating SQS queue %s...", opts.QueueName)
+	if opts.ContentBasedDeduplication && !opts.FIFO {
+		return "", fmt.Errorf("content-based deduplication is only supported by FIFO queues")
+	}
+	if opts.FIFO {
+		opts.QueueName = fifoName(opts.QueueName)
+		if opts.DeadLetterQueueName != "" {
+			opts.DeadLetterQueueName = fifoName(opts.DeadLetterQueueName)
+		}
+	}
+
+	logging.Debug(opts.log(), "creating SQS queue", logging.F(logging.FieldQueue, opts.QueueName))
 
-	sess, err := session.NewSession()
+	sess, err := opts.AWS.NewSession()
 	if err != nil {
-		return "", fmt.Errorf("error creating AWS session (check environment variables): %s", err)
+		return "", err
 	}
 
 	// Create SQS service
 	sqsService := sqs.New(sess)
 
-	opts.logf("Listing existing queues...")
-
-	// List all SQS queues beginning with the same name
-	// and select the correct queue or create a new queue
-	lqi := &sqs.ListQueuesInput{
-		QueueNamePrefix: aws.String(opts.QueueName),
-	}
-	listResult, err := sqsService.ListQueues(lqi)
-	if err != nil {
-		return "", fmt.Errorf("error listing SQS queues: %s", err)
+	if opts.DeadLetterQueueName != "" {
+		opts.DeadLetterQueueURL, err = findOrCreateQueue(sqsService, opts.DeadLetterQueueName, opts)
+		if err != nil {
+			return "", err
+		}
+		logging.Info(opts.log(), "using dead-letter queue", logging.F("queue_url", opts.DeadLetterQueueURL))
 	}
 
-	// Find the exact queue name
-	for _, q := range listResult.QueueUrls {
-		if strings.HasSuffix(aws.StringValue(q), "/"+opts.QueueName) {
-			sqsQueueURL = aws.StringValue(q)
-			break
-		}
+	sqsQueueURL, err = findQueue(sqsService, opts.QueueName, opts)
+	if err != nil {
+		return "", err
 	}
 	if len(sqsQueueURL) > 0 {
 		// The queue already exists, we are done
-		opts.logf("Using existing SQS queue with URL %s", sqsQueueURL)
+		logging.Info(opts.log(), "using existing SQS queue", logging.F("queue_url", sqsQueueURL))
 		return sqsQueueURL, nil
 	}
 
 	// There is no SQS queue with this name yet, create it
-	cqi := &sqs.CreateQueueInput{
-		QueueName: aws.String(opts.QueueName),
-	}
-
-	// A recently deleted queue cannot be recreated immediately, for safety we will build a retry mechanism here
-	for nTries := 0; nTries < 12; nTries++ {
-
-		createResponse, err := sqsService.CreateQueue(cqi)
-		if err != nil {
-			if strings.HasPrefix(err.Error(), "AWS.SimpleQueueService.QueueDeletedRecently") {
-				opts.logf("Waiting 10 seconds for recently deleted queue to become available again...")
-				time.Sleep(10 * time.Second)
-				continue
-			} else {
-				return "", fmt.Errorf("error creating SQS queue: %s", err)
-			}
-		}
-		sqsQueueURL = aws.StringValue(createResponse.QueueUrl)
+	sqsQueueURL, err = createQueue(sqsService, opts.QueueName, opts)
+	if err != nil {
+		return "", err
 	}
 
-	opts.logf("Created SQS status queue with URL %s", sqsQueueURL)
+	logging.Info(opts.log(), "created SQS queue", logging.F("queue_url", sqsQueueURL))
 
 	// We now need to get the ARN of the created status queue
 	gqai := &sqs.GetQueueAttributesInput{
@@ -106,10 +122,10 @@ func CreateAndSubscribe(opts *CreateOptions) (string, error) {
 	// We now create the SNS service for each topic because the regions can differ and subscribe the new queue to all the SNS topics
 	for _, topicARN := range opts.SNSTopicARNs {
 
-		if err := subscribeQueueToSNSTopic(sess, sqsQueueARN, topicARN); err != nil {
+		if err := subscribeQueueToSNSTopic(sess, sqsQueueARN, topicARN, opts); err != nil {
 			return sqsQueueURL, err
 		}
-		opts.logf("Subscribed SQS ARN %s to SNS topic ARN %s", sqsQueueARN, topicARN)
+		logging.Info(opts.log(), "subscribed SQS queue to SNS topic", logging.F("queue_arn", sqsQueueARN), logging.F("topic_arn", topicARN))
 	}
 
 	// We now need to set the required queue attributes and policy
@@ -126,6 +142,14 @@ func CreateAndSubscribe(opts *CreateOptions) (string, error) {
 		"ReceiveMessageWaitTimeSeconds": "20",
 	}
 
+	if opts.DeadLetterQueueURL != "" && opts.MaxReceiveCount > 0 {
+		redrivePolicy, err := newRedrivePolicy(sqsService, opts.DeadLetterQueueURL, opts.MaxReceiveCount)
+		if err != nil {
+			return sqsQueueURL, err
+		}
+		qAttrs["RedrivePolicy"] = redrivePolicy
+	}
+
 	sqai := &sqs.SetQueueAttributesInput{
 		QueueUrl:   aws.String(sqsQueueURL),
 		Attributes: aws.StringMap(qAttrs),
@@ -135,12 +159,85 @@ func CreateAndSubscribe(opts *CreateOptions) (string, error) {
 		return sqsQueueURL, fmt.Errorf("error setting SQS queue attributes: %s", err)
 	}
 
-	opts.logf("Queue attributes set successfully, queue creation is now complete")
+	logging.Debug(opts.log(), "queue attributes set successfully, queue creation is now complete", logging.F("queue_url", sqsQueueURL))
 
 	return sqsQueueURL, nil
 }
 
-func subscribeQueueToSNSTopic(sess *session.Session, sqsQueueARN, topicARN string) error {
+// findQueue returns the URL of the queue with exactly this name, or an empty string if it does not exist
+func findQueue(sqsService *sqs.SQS, queueName string, opts *CreateOptions) (string, error) {
+
+	logging.Debug(opts.log(), "listing existing queues", logging.F("prefix", queueName))
+
+	// List all SQS queues beginning with the same name
+	// and select the correct queue
+	lqi := &sqs.ListQueuesInput{
+		QueueNamePrefix: aws.String(queueName),
+	}
+	listResult, err := sqsService.ListQueues(lqi)
+	if err != nil {
+		return "", fmt.Errorf("error listing SQS queues: %s", err)
+	}
+
+	// Find the exact queue name
+	for _, q := range listResult.QueueUrls {
+		if strings.HasSuffix(aws.StringValue(q), "/"+queueName) {
+			return aws.StringValue(q), nil
+		}
+	}
+	return "", nil
+}
+
+// createQueue creates a new queue and returns its URL
+func createQueue(sqsService *sqs.SQS, queueName string, opts *CreateOptions) (string, error) {
+
+	cqi := &sqs.CreateQueueInput{
+		QueueName: aws.String(queueName),
+	}
+	if opts.FIFO {
+		// FIFO queues can only be created with these attributes, they cannot be set later
+		cqi.Attributes = aws.StringMap(map[string]string{
+			sqs.QueueAttributeNameFifoQueue:                 "true",
+			sqs.QueueAttributeNameContentBasedDeduplication: strconv.FormatBool(opts.ContentBasedDeduplication),
+		})
+	}
+
+	// A recently deleted queue cannot be recreated immediately, for safety we will build a retry mechanism here
+	for nTries := 0; nTries < 12; nTries++ {
+
+		createResponse, err := sqsService.CreateQueue(cqi)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "AWS.SimpleQueueService.QueueDeletedRecently") {
+				logging.Info(opts.log(), "waiting 10 seconds for recently deleted queue to become available again", logging.F(logging.FieldQueue, queueName))
+				time.Sleep(10 * time.Second)
+				continue
+			} else {
+				return "", fmt.Errorf("error creating SQS queue: %s", err)
+			}
+		}
+		return aws.StringValue(createResponse.QueueUrl), nil
+	}
+
+	return "", fmt.Errorf("error creating SQS queue %s: queue was deleted recently", queueName)
+}
+
+// fifoName returns the queue name with the .fifo suffix FIFO queues require
+func fifoName(queueName string) string {
+	if strings.HasSuffix(queueName, fifoSuffix) {
+		return queueName
+	}
+	return queueName + fifoSuffix
+}
+
+func findOrCreateQueue(sqsService *sqs.SQS, queueName string, opts *CreateOptions) (string, error) {
+	queueURL, err := findQueue(sqsService, queueName, opts)
+	if err != nil || queueURL != "" {
+		return queueURL, err
+	}
+	return createQueue(sqsService, queueName, opts)
+}
+
+func subscribeQueueToSNSTopic(sess *session.Session, sqsQueueARN, topicARN string, opts *CreateOptions) error {
 
 	ARN, err := arn.Parse(topicARN)
 	if err != nil {
@@ -148,6 +245,15 @@ func subscribeQueueToSNSTopic(sess *session.Session, sqsQueueARN, topicARN strin
 	}
 
 	snsConfig := aws.NewConfig().WithRegion(ARN.Region)
+
+	roleARN, err := snsRoleARN(ARN.AccountID, opts.SNSRoleARNs)
+	if err != nil {
+		return err
+	}
+	if roleARN != "" {
+		logging.Debug(opts.log(), "assuming role to subscribe to SNS topic", logging.F("role_arn", roleARN), logging.F("topic_arn", topicARN))
+		snsConfig.WithCredentials(opts.AWS.AssumeRole(sess, roleARN))
+	}
 	snsService := sns.New(sess, snsConfig)
 
 	si := &sns.SubscribeInput{
@@ -174,3 +280,17 @@ func subscribeQueueToSNSTopic(sess *session.Session, sqsQueueARN, topicARN strin
 
 	return nil
 }
+
+// snsRoleARN returns the role in roleARNs for accountID, or an empty string when there is none
+func snsRoleARN(accountID string, roleARNs []string) (string, error) {
+	for _, roleARN := range roleARNs {
+		ARN, err := arn.Parse(roleARN)
+		if err != nil {
+			return "", fmt.Errorf("error parsing SNS role ARN %s: %s", roleARN, err)
+		}
+		if ARN.AccountID == accountID {
+			return roleARN, nil
+		}
+	}
+	return "", nil
+}
@@ -3,6 +3,10 @@ package createqueue
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 type policyDocument struct {
@@ -47,3 +51,29 @@ func NewSQSSendPolicyForSNSSourceARNs(sqsARN string, snsARNs []string) (string,
 	buf, err := json.Marshal(p)
 	return string(buf), err
 }
+
+type redrivePolicy struct {
+	DeadLetterTargetARN string `json:"deadLetterTargetArn"`
+	MaxReceiveCount     string `json:"maxReceiveCount"`
+}
+
+// newRedrivePolicy returns the RedrivePolicy JSON document for the dead-letter queue with URL dlqURL
+func newRedrivePolicy(sqsService *sqs.SQS, dlqURL string, maxReceiveCount int) (string, error) {
+
+	gqai := &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(dlqURL),
+		AttributeNames: aws.StringSlice([]string{"QueueArn"}),
+	}
+	queueAttributes, err := sqsService.GetQueueAttributes(gqai)
+	if err != nil {
+		return "", fmt.Errorf("error getting dead-letter queue attributes: %s", err)
+	}
+
+	p := &redrivePolicy{
+		DeadLetterTargetARN: aws.StringValue(queueAttributes.Attributes["QueueArn"]),
+		MaxReceiveCount:     strconv.Itoa(maxReceiveCount),
+	}
+
+	buf, err := json.Marshal(p)
+	return string(buf), err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/internal/yaml"
+)
+
+// sqsdNamespace is the namespace of the worker daemon options in Elastic Beanstalk
+const sqsdNamespace = "aws:elasticbeanstalk:sqsd"
+
+// optionSettingsRegexp matches the top level option_settings key of a YAML config file
+var optionSettingsRegexp = regexp.MustCompile(`^option_settings\s*:`)
+
+// optionSetting is an entry of the long option_settings form
+type optionSetting struct {
+	Namespace  string          `json:"namespace"`
+	OptionName string          `json:"option_name"`
+	Value      json.RawMessage `json:"value"`
+}
+
+// readEBExtensions reads the aws:elasticbeanstalk:sqsd option settings from path, a .ebextensions directory
+// or a single config file. The .config files of a directory are read in alphabetical order, like Elastic Beanstalk
+// does, so later files override earlier files. Settings that cannot be used locally, like references to
+// CloudFormation resources, are returned as warnings.
+func readEBExtensions(path string) (configValues, []string, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("error reading .ebextensions: %s", err)
+	} else if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.config")); err != nil {
+			return nil, nil, fmt.Errorf("error listing .ebextensions: %s", err)
+		}
+		sort.Strings(files)
+	}
+
+	values := make(configValues)
+	var warnings []string
+	for _, file := range files {
+		settings, err := readOptionSettings(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, s := range settings {
+			if s.Namespace != sqsdNamespace {
+				continue
+			}
+			opt := lookupOption(s.OptionName)
+			if opt == nil {
+				warnings = append(warnings, fmt.Sprintf("%s: unknown option %s ignored", file, s.OptionName))
+				continue
+			}
+			value, err := rawValue(s.Value)
+			if err != nil || strings.HasPrefix(value, "`") {
+				warnings = append(warnings, fmt.Sprintf("%s: option %s is not a literal value and is ignored", file, s.OptionName))
+				continue
+			}
+			values[opt.name] = configValue{value: value, file: file}
+		}
+	}
+	return values, warnings, nil
+}
+
+// readOptionSettings returns the option settings of a config file in the long form.
+// Only the option_settings section of YAML files is parsed, the other sections can contain
+// CloudFormation syntax that is not needed here.
+func readOptionSettings(file string) ([]*optionSetting, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading .ebextensions: %s", err)
+	}
+	if trimmed := bytes.TrimSpace(b); len(trimmed) == 0 || trimmed[0] != '{' {
+		b = optionSettingsSection(b)
+	}
+
+	var doc struct {
+		OptionSettings json.RawMessage `json:"option_settings"`
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", file, err)
+	}
+
+	raw := bytes.TrimSpace(doc.OptionSettings)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	// the long form is a list of settings
+	if raw[0] == '[' {
+		var settings []*optionSetting
+		if err := json.Unmarshal(raw, &settings); err != nil {
+			return nil, fmt.Errorf("error parsing option_settings in %s: %s", file, err)
+		}
+		return settings, nil
+	}
+
+	// the short form maps namespaces to options and their values
+	var namespaces map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &namespaces); err != nil {
+		return nil, fmt.Errorf("error parsing option_settings in %s: %s", file, err)
+	}
+	var settings []*optionSetting
+	for namespace, opts := range namespaces {
+		for name, value := range opts {
+			settings = append(settings, &optionSetting{Namespace: namespace, OptionName: name, Value: value})
+		}
+	}
+	return settings, nil
+}
+
+// optionSettingsSection returns the top level option_settings key of a YAML file with its indented lines
+func optionSettingsSection(b []byte) []byte {
+	var section [][]byte
+	in := false
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		topLevel := len(line) > 0 && line[0] != ' ' && line[0] != '\t' && line[0] != '#' && line[0] != '\r'
+		if topLevel {
+			in = optionSettingsRegexp.Match(line)
+		}
+		if in {
+			section = append(section, line)
+		}
+	}
+	return bytes.Join(section, []byte("\n"))
+}
+
+// ignoreDeployedQueue clears WorkerQueueURL when it was read from .ebextensions and messages are received
+// from another queue, so the deployed settings can be used with a local or newly created queue
+func ignoreDeployedQueue(fs *flag.FlagSet, sources map[string]string, ebextensions configValues) {
+	v, ok := ebextensions["WorkerQueueURL"]
+	if !ok || sources["sqs-url"] != "set in "+v.file {
+		return
+	}
+	for _, name := range []string{"sqs-create-queue", "source-dir", "local"} {
+		if value := fs.Lookup(name).Value.String(); value != "" && value != "false" {
+			fs.Set("sqs-url", "")
+			sources["sqs-url"] = "ignored, " + name + " is used instead of WorkerQueueURL from " + v.file
+			return
+		}
+	}
+}
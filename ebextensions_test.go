@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReadOptionSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string // namespace/option_name=value, sorted, nil when an error is expected
+	}{
+		{
+			name: "short form",
+			in: "option_settings:\n" +
+				"  aws:elasticbeanstalk:sqsd:\n" +
+				"    HttpPath: /worker\n" +
+				"    VisibilityTimeout: 300\n" +
+				"  aws:elasticbeanstalk:application:environment:\n" +
+				"    STAGE: dev\n",
+			want: []string{
+				"aws:elasticbeanstalk:application:environment/STAGE=\"dev\"",
+				"aws:elasticbeanstalk:sqsd/HttpPath=\"/worker\"",
+				"aws:elasticbeanstalk:sqsd/VisibilityTimeout=300",
+			},
+		},
+		{
+			name: "long form",
+			in: "option_settings:\n" +
+				"  - namespace: aws:elasticbeanstalk:sqsd\n" +
+				"    option_name: HttpConnections\n" +
+				"    value: 10\n" +
+				"  - namespace: aws:elasticbeanstalk:sqsd\n" +
+				"    option_name: WorkerQueueURL\n" +
+				"    value: '`{\"Ref\": \"WorkerQueue\"}`'\n",
+			want: []string{
+				"aws:elasticbeanstalk:sqsd/HttpConnections=10",
+				"aws:elasticbeanstalk:sqsd/WorkerQueueURL=\"`{\\\"Ref\\\": \\\"WorkerQueue\\\"}`\"",
+			},
+		},
+		{
+			name: "other sections with CloudFormation syntax are ignored",
+			in: "Resources:\n" +
+				"  WorkerQueue:\n" +
+				"    Type: AWS::SQS::Queue\n" +
+				"    Properties:\n" +
+				"      QueueName: !Sub '${AWS::StackName}-worker'\n" +
+				"# comment\n" +
+				"option_settings:\r\n" +
+				"  aws:elasticbeanstalk:sqsd:\r\n" +
+				"    MimeType: text/plain\r\n" +
+				"files:\n" +
+				"  /etc/x: {content: !GetAtt [A, B]}\n",
+			want: []string{"aws:elasticbeanstalk:sqsd/MimeType=\"text/plain\""},
+		},
+		{
+			name: "JSON",
+			in:   `{"option_settings": [{"namespace": "aws:elasticbeanstalk:sqsd", "option_name": "HttpPath", "value": "/json"}]}`,
+			want: []string{"aws:elasticbeanstalk:sqsd/HttpPath=\"/json\""},
+		},
+		{
+			name: "no option settings",
+			in:   "packages:\n  yum:\n    git: []\n",
+			want: []string{},
+		},
+		{
+			name: "empty option settings",
+			in:   "option_settings:\n",
+			want: []string{},
+		},
+		{
+			name: "invalid YAML",
+			in:   "option_settings:\n  aws:elasticbeanstalk:sqsd:\n\tHttpPath: /worker\n",
+		},
+		{
+			name: "option_settings is not a list or mapping",
+			in:   "option_settings: 1\n",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "ebextensions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, string('a'+rune(i))+".config")
+			if err := ioutil.WriteFile(file, []byte(test.in), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			settings, err := readOptionSettings(file)
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %d settings", len(settings))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, s := range settings {
+				got = append(got, s.Namespace+"/"+s.OptionName+"="+string(s.Value))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadEBExtensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebextensions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"01-worker.config": "option_settings:\n  aws:elasticbeanstalk:sqsd:\n    HttpPath: /first\n    HttpConnections: 5\n    Unknown: x\n",
+		"02-worker.config": "option_settings:\n  aws:elasticbeanstalk:sqsd:\n    HttpPath: /second\n    WorkerQueueURL: '`{\"Ref\": \"Queue\"}`'\n",
+		"notes.txt":        "option_settings: [",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values, warnings, err := readEBExtensions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// later files override earlier files
+	if v := values["HttpPath"]; v.value != "/second" || filepath.Base(v.file) != "02-worker.config" {
+		t.Errorf("HttpPath is %q from %s, want /second from 02-worker.config", v.value, v.file)
+	}
+	if v := values["HttpConnections"]; v.value != "5" {
+		t.Errorf("HttpConnections is %q, want 5", v.value)
+	}
+	if _, ok := values["WorkerQueueURL"]; ok {
+		t.Error("WorkerQueueURL with a CloudFormation reference is used")
+	}
+	if len(warnings) != 2 {
+		t.Errorf("got warnings %q, want 2 for Unknown and WorkerQueueURL", warnings)
+	}
+}
@@ -0,0 +1,53 @@
+// Package yaml decodes Elastic Beanstalk configuration files such as cron.yaml and .ebextensions.
+//
+// Documents are parsed as YAML 1.1 with gopkg.in/yaml.v2, like Elastic Beanstalk does, and then
+// decoded like JSON, so struct fields use json tags and json.RawMessage fields receive the JSON
+// encoding of a value. Duplicate keys are an error. Input starting with { or [ is decoded as JSON.
+package yaml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Unmarshal decodes the YAML (or JSON) document in data into v.
+// Decoding into v follows the encoding/json rules, so struct fields can use json tags.
+func Unmarshal(data []byte, v interface{}) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return json.Unmarshal(trimmed, v)
+	}
+
+	var doc interface{}
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(jsonValue(doc))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// jsonValue converts the mappings of a decoded YAML value, which can have keys of any type, to JSON objects
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
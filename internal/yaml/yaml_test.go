@@ -0,0 +1,165 @@
+package yaml
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string // JSON encoding of the decoded document, empty when an error is expected
+	}{
+		{
+			name: "mapping",
+			in:   "a: 1\nb: two\nc: true\nd: ~\ne: 1.5\n",
+			want: `{"a":1,"b":"two","c":true,"d":null,"e":1.5}`,
+		},
+		{
+			name: "nested mappings and sequences",
+			in:   "a:\n  b:\n    - 1\n    - c: d\n      e: f\n",
+			want: `{"a":{"b":[1,{"c":"d","e":"f"}]}}`,
+		},
+		{
+			name: "tab indentation",
+			in:   "a:\n\tb: 1\n",
+		},
+		{
+			name: "CRLF line endings",
+			in:   "a: 1\r\nb:\r\n  - c\r\n  - d\r\n",
+			want: `{"a":1,"b":["c","d"]}`,
+		},
+		{
+			// like Elastic Beanstalk, which reads config files as YAML 1.1
+			name: "YAML 1.1 booleans",
+			in:   "a: yes\nb: off\nc: \"on\"\n",
+			want: `{"a":true,"b":false,"c":"on"}`,
+		},
+		{
+			name: "quoted strings and comments",
+			in:   "# comment\na: \"b # not a comment\" # comment\nc: 'it''s'\nd: \"*/5 * * * *\"\n",
+			want: `{"a":"b # not a comment","c":"it's","d":"*/5 * * * *"}`,
+		},
+		{
+			name: "flow collections",
+			in:   "a: [1, b, {c: d}]\ne: {f: [g, h], i: 'j, k'}\n",
+			want: `{"a":[1,"b",{"c":"d"}],"e":{"f":["g","h"],"i":"j, k"}}`,
+		},
+		{
+			name: "multi line flow collection",
+			in:   "a: [1,\n  2]\n",
+			want: `{"a":[1,2]}`,
+		},
+		{
+			name: "literal block scalar",
+			in:   "a: |\n  x\n    y\n\nb: 1\n",
+			want: `{"a":"x\n  y\n","b":1}`,
+		},
+		{
+			name: "folded block scalar with strip",
+			in:   "a: >-\n  x\n  y\n",
+			want: `{"a":"x y"}`,
+		},
+		{
+			name: "document markers",
+			in:   "---\na: 1\n...\n",
+			want: `{"a":1}`,
+		},
+		{
+			name: "empty document",
+			in:   "# nothing\n",
+			want: `null`,
+		},
+		{
+			name: "JSON",
+			in:   "{\n\t\"a\": [1, \"b\"]\n}\n",
+			want: `{"a":[1,"b"]}`,
+		},
+		{
+			name: "unclosed flow sequence",
+			in:   "a: [1, 2\n",
+		},
+		{
+			name: "duplicate key",
+			in:   "a: 1\na: 2\n",
+		},
+		{
+			name: "bad indentation",
+			in:   "a:\n    b: 1\n  c: 2\n",
+		},
+		{
+			name: "ebextensions short form",
+			in: "option_settings:\n" +
+				"  aws:elasticbeanstalk:sqsd:\n" +
+				"    HttpPath: /worker\n" +
+				"    VisibilityTimeout: 300\n",
+			want: `{"option_settings":{"aws:elasticbeanstalk:sqsd":{"HttpPath":"/worker","VisibilityTimeout":300}}}`,
+		},
+		{
+			name: "ebextensions long form",
+			in: "option_settings:\n" +
+				"  - namespace: aws:elasticbeanstalk:sqsd\n" +
+				"    option_name: WorkerQueueURL\n" +
+				"    value: https://sqs.eu-west-1.amazonaws.com/123456789012/worker\n" +
+				"  - namespace: aws:elasticbeanstalk:sqsd\n" +
+				"    option_name: InactivityTimeout\n" +
+				"    value: '60'\n",
+			want: `{"option_settings":[` +
+				`{"namespace":"aws:elasticbeanstalk:sqsd","option_name":"WorkerQueueURL","value":"https://sqs.eu-west-1.amazonaws.com/123456789012/worker"},` +
+				`{"namespace":"aws:elasticbeanstalk:sqsd","option_name":"InactivityTimeout","value":"60"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var v interface{}
+			err := Unmarshal([]byte(test.in), &v)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("expected an error, decoded %v", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	in := "version: 1\ncron:\n - name: backup\n   url: /backup\n   schedule: \"0 */12 * * *\"\n"
+	var v struct {
+		Version int `json:"version"`
+		Cron    []struct {
+			Name     string `json:"name"`
+			URL      string `json:"url"`
+			Schedule string `json:"schedule"`
+		} `json:"cron"`
+	}
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != 1 || len(v.Cron) != 1 {
+		t.Fatalf("unexpected result %+v", v)
+	}
+	if c := v.Cron[0]; c.Name != "backup" || c.URL != "/backup" || c.Schedule != "0 */12 * * *" {
+		t.Errorf("unexpected task %+v", c)
+	}
+
+	// numbers can not be decoded in string fields, like encoding/json
+	var s struct {
+		Name string `json:"name"`
+	}
+	if err := Unmarshal([]byte("name: 1\n"), &s); err == nil {
+		t.Error("expected an error decoding a number into a string field")
+	}
+}
@@ -0,0 +1,524 @@
+package localsqs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/sqsd"
+)
+
+// Limits of SQS
+const (
+	maxMessageSize       = 256 * 1024
+	maxDelaySeconds      = 900
+	maxWaitTimeSeconds   = 20
+	maxVisibilityTimeout = 43200
+	maxBatchEntries      = 10
+)
+
+var batchEntryIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,80}$`)
+
+var actions = map[string]func(*Server, *http.Request, *request) (interface{}, error){
+	"CreateQueue":             (*Server).createQueueAction,
+	"GetQueueUrl":             (*Server).getQueueURL,
+	"GetQueueAttributes":      (*Server).getQueueAttributes,
+	"SendMessage":             (*Server).sendMessage,
+	"SendMessageBatch":        (*Server).sendMessageBatch,
+	"ReceiveMessage":          (*Server).receiveMessage,
+	"DeleteMessage":           (*Server).deleteMessage,
+	"DeleteMessageBatch":      (*Server).deleteMessageBatch,
+	"ChangeMessageVisibility": (*Server).changeMessageVisibility,
+}
+
+type queueURLResult struct {
+	QueueURL string `json:"QueueUrl" xml:"QueueUrl"`
+}
+
+type getQueueAttributesResult struct {
+	Attributes attributeMap `json:",omitempty" xml:"Attribute,omitempty"`
+}
+
+type sendMessageResult struct {
+	ID                     string `json:"Id,omitempty" xml:"Id,omitempty"`
+	MessageID              string `json:"MessageId" xml:"MessageId"`
+	MD5OfMessageBody       string
+	MD5OfMessageAttributes string `json:",omitempty" xml:",omitempty"`
+	SequenceNumber         string `json:",omitempty" xml:",omitempty"`
+}
+
+type sendMessageBatchResult struct {
+	Successful []*sendMessageResult     `xml:"SendMessageBatchResultEntry"`
+	Failed     []*batchResultErrorEntry `xml:"BatchResultErrorEntry"`
+}
+
+type deleteMessageBatchResult struct {
+	Successful []*batchResultEntry      `xml:"DeleteMessageBatchResultEntry"`
+	Failed     []*batchResultErrorEntry `xml:"BatchResultErrorEntry"`
+}
+
+type batchResultEntry struct {
+	ID string `json:"Id" xml:"Id"`
+}
+
+type batchResultErrorEntry struct {
+	ID          string `json:"Id" xml:"Id"`
+	Code        string
+	Message     string
+	SenderFault bool
+}
+
+type receiveMessageResult struct {
+	Messages []*message `json:",omitempty" xml:"Message"`
+}
+
+type message struct {
+	MessageID              string `json:"MessageId" xml:"MessageId"`
+	ReceiptHandle          string
+	MD5OfBody              string
+	Body                   string
+	Attributes             attributeMap        `json:",omitempty" xml:"Attribute,omitempty"`
+	MD5OfMessageAttributes string              `json:",omitempty" xml:",omitempty"`
+	MessageAttributes      messageAttributeMap `json:",omitempty" xml:"MessageAttribute,omitempty"`
+}
+
+func (s *Server) createQueueAction(r *http.Request, in *request) (interface{}, error) {
+	if in.QueueName == "" {
+		return nil, missingParameter("QueueName")
+	}
+	if _, err := s.createQueue(in.QueueName, in.Attributes); err != nil {
+		return nil, err
+	}
+	return &queueURLResult{QueueURL: s.queueURL(r, in.QueueName)}, nil
+}
+
+func (s *Server) getQueueURL(r *http.Request, in *request) (interface{}, error) {
+	if in.QueueName == "" {
+		return nil, missingParameter("QueueName")
+	}
+	if _, err := s.lookup(in.QueueName); err != nil {
+		return nil, err
+	}
+	return &queueURLResult{QueueURL: s.queueURL(r, in.QueueName)}, nil
+}
+
+// queue returns the queue of the QueueUrl parameter
+func (s *Server) queue(in *request) (*queue, error) {
+	if in.QueueURL == "" {
+		return nil, missingParameter("QueueUrl")
+	}
+	return s.lookup(in.QueueURL[strings.LastIndex(in.QueueURL, "/")+1:])
+}
+
+func (s *Server) getQueueAttributes(r *http.Request, in *request) (interface{}, error) {
+	q, err := s.queue(in)
+	if err != nil {
+		return nil, err
+	}
+
+	total, inFlight := q.Len()
+	attrs := make(attributeMap, len(q.attributes)+10)
+	for name, val := range q.attributes {
+		attrs[name] = val
+	}
+	attrs["QueueArn"] = s.queueARN(q.Name)
+	attrs["ApproximateNumberOfMessages"] = strconv.Itoa(total - inFlight)
+	attrs["ApproximateNumberOfMessagesNotVisible"] = strconv.Itoa(inFlight)
+	attrs["ApproximateNumberOfMessagesDelayed"] = "0"
+	attrs["CreatedTimestamp"] = strconv.FormatInt(q.created.Unix(), 10)
+	attrs["LastModifiedTimestamp"] = strconv.FormatInt(q.created.Unix(), 10)
+	attrs["VisibilityTimeout"] = strconv.Itoa(int(q.VisibilityTimeout / time.Second))
+	attrs["DelaySeconds"] = strconv.Itoa(int(q.delay / time.Second))
+	attrs["ReceiveMessageWaitTimeSeconds"] = strconv.Itoa(int(q.waitTime / time.Second))
+
+	out := &getQueueAttributesResult{Attributes: make(attributeMap)}
+	for name, val := range attrs {
+		if selected(name, in.AttributeNames, false) {
+			out.Attributes[name] = val
+		}
+	}
+	return out, nil
+}
+
+func (s *Server) sendMessage(r *http.Request, in *request) (interface{}, error) {
+	q, err := s.queue(in)
+	if err != nil {
+		return nil, err
+	}
+	return send(r.Context(), q, in)
+}
+
+func (s *Server) sendMessageBatch(r *http.Request, in *request) (interface{}, error) {
+	q, err := s.queue(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBatch(in.Entries); err != nil {
+		return nil, err
+	}
+
+	out := &sendMessageBatchResult{
+		Successful: make([]*sendMessageResult, 0, len(in.Entries)),
+		Failed:     make([]*batchResultErrorEntry, 0),
+	}
+	for _, entry := range in.Entries {
+		res, err := send(r.Context(), q, entry)
+		if err != nil {
+			out.Failed = append(out.Failed, batchError(entry, err))
+			continue
+		}
+		res.ID = entry.ID
+		out.Successful = append(out.Successful, res)
+	}
+	return out, nil
+}
+
+func send(ctx context.Context, q *queue, in *request) (*sendMessageResult, error) {
+	if in.MessageBody == "" {
+		return nil, missingParameter("MessageBody")
+	}
+	if len(in.MessageBody) > maxMessageSize {
+		return nil, invalidParameter("One or more parameters are invalid. Reason: Message must be shorter than %d bytes.", maxMessageSize)
+	}
+
+	delay := q.delay
+	if in.DelaySeconds != nil {
+		if *in.DelaySeconds < 0 || *in.DelaySeconds > maxDelaySeconds {
+			return nil, invalidParameter("Value %d for parameter DelaySeconds is invalid. Reason: must be between 0 and %d.", *in.DelaySeconds, maxDelaySeconds)
+		}
+		delay = time.Duration(*in.DelaySeconds) * time.Second
+	}
+
+	msg := &sqsd.Message{Body: in.MessageBody}
+	if q.FIFO {
+		if in.MessageGroupID == "" {
+			return nil, missingParameter("MessageGroupId")
+		}
+		if in.DelaySeconds != nil {
+			return nil, invalidParameter("Value %d for parameter DelaySeconds is invalid. Reason: The request include parameter that is not valid for this queue type.", *in.DelaySeconds)
+		}
+		if in.MessageDeduplicationID == "" && !q.ContentBasedDeduplication {
+			return nil, invalidParameter("The queue should either have ContentBasedDeduplication enabled or MessageDeduplicationId provided explicitly")
+		}
+		msg.Attributes = map[string]string{
+			sqsd.AttributeMessageGroupID:         in.MessageGroupID,
+			sqsd.AttributeMessageDeduplicationID: in.MessageDeduplicationID,
+		}
+	}
+	for name, attr := range in.MessageAttributes {
+		if name == "" || attr == nil {
+			return nil, invalidParameter("Message attribute name and value are required.")
+		}
+		if !strings.HasPrefix(attr.DataType, "String") && !strings.HasPrefix(attr.DataType, "Number") && !strings.HasPrefix(attr.DataType, "Binary") {
+			return nil, invalidParameter("The type of message attribute %s is invalid. Must be one of String, Number or Binary.", name)
+		}
+		if msg.MessageAttributes == nil {
+			msg.MessageAttributes = make(map[string]*sqsd.MessageAttribute, len(in.MessageAttributes))
+		}
+		msg.MessageAttributes[name] = &sqsd.MessageAttribute{
+			DataType:    attr.DataType,
+			StringValue: attr.StringValue,
+			BinaryValue: attr.BinaryValue,
+		}
+	}
+
+	if err := q.Send(ctx, msg, delay); err != nil {
+		return nil, err
+	}
+
+	return &sendMessageResult{
+		MessageID:              msg.ID,
+		MD5OfMessageBody:       md5Hex([]byte(in.MessageBody)),
+		MD5OfMessageAttributes: md5OfMessageAttributes(in.MessageAttributes),
+		SequenceNumber:         msg.Attributes[sqsd.AttributeSequenceNumber],
+	}, nil
+}
+
+func (s *Server) receiveMessage(r *http.Request, in *request) (interface{}, error) {
+	q, err := s.queue(in)
+	if err != nil {
+		return nil, err
+	}
+
+	max := 1
+	if in.MaxNumberOfMessages != nil {
+		if *in.MaxNumberOfMessages < 1 || *in.MaxNumberOfMessages > maxBatchEntries {
+			return nil, invalidParameter("Value %d for parameter MaxNumberOfMessages is invalid. Reason: must be between 1 and %d.", *in.MaxNumberOfMessages, maxBatchEntries)
+		}
+		max = *in.MaxNumberOfMessages
+	}
+	wait := q.waitTime
+	if in.WaitTimeSeconds != nil {
+		if *in.WaitTimeSeconds < 0 || *in.WaitTimeSeconds > maxWaitTimeSeconds {
+			return nil, invalidParameter("Value %d for parameter WaitTimeSeconds is invalid. Reason: must be between 0 and %d.", *in.WaitTimeSeconds, maxWaitTimeSeconds)
+		}
+		wait = time.Duration(*in.WaitTimeSeconds) * time.Second
+	}
+	if in.VisibilityTimeout != nil {
+		if err := validateVisibilityTimeout(*in.VisibilityTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	msgs, err := q.Receive(ctx, max)
+	cancel()
+	if err != nil && err != context.DeadlineExceeded {
+		return nil, err
+	}
+
+	systemAttributeNames := append(in.AttributeNames, in.MessageSystemAttributeNames...)
+	out := new(receiveMessageResult)
+	for _, msg := range msgs {
+		if in.VisibilityTimeout != nil {
+			q.Extend(r.Context(), msg, time.Duration(*in.VisibilityTimeout)*time.Second)
+		}
+
+		m := &message{
+			MessageID:     msg.ID,
+			ReceiptHandle: msg.ReceiptHandle,
+			MD5OfBody:     md5Hex([]byte(msg.Body)),
+			Body:          msg.Body,
+		}
+		for name, val := range msg.Attributes {
+			if selected(name, systemAttributeNames, false) {
+				if m.Attributes == nil {
+					m.Attributes = make(attributeMap)
+				}
+				m.Attributes[name] = val
+			}
+		}
+		for name, attr := range msg.MessageAttributes {
+			if selected(name, in.MessageAttributeNames, true) {
+				if m.MessageAttributes == nil {
+					m.MessageAttributes = make(messageAttributeMap)
+				}
+				m.MessageAttributes[name] = &messageAttribute{
+					DataType:    attr.DataType,
+					StringValue: attr.StringValue,
+					BinaryValue: attr.BinaryValue,
+				}
+			}
+		}
+		m.MD5OfMessageAttributes = md5OfMessageAttributes(m.MessageAttributes)
+		out.Messages = append(out.Messages, m)
+	}
+
+	s.debug("SQS API received messages", logging.F(logging.FieldQueue, q.Name), logging.F("count", len(out.Messages)))
+	return out, nil
+}
+
+func (s *Server) deleteMessage(r *http.Request, in *request) (interface{}, error) {
+	q, err := s.queue(in)
+	if err != nil {
+		return nil, err
+	}
+	return nil, deleteMessage(r.Context(), q, in)
+}
+
+func (s *Server) deleteMessageBatch(r *http.Request, in *request) (interface{}, error) {
+	q, err := s.queue(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBatch(in.Entries); err != nil {
+		return nil, err
+	}
+
+	out := &deleteMessageBatchResult{
+		Successful: make([]*batchResultEntry, 0, len(in.Entries)),
+		Failed:     make([]*batchResultErrorEntry, 0),
+	}
+	for _, entry := range in.Entries {
+		if err := deleteMessage(r.Context(), q, entry); err != nil {
+			out.Failed = append(out.Failed, batchError(entry, err))
+			continue
+		}
+		out.Successful = append(out.Successful, &batchResultEntry{ID: entry.ID})
+	}
+	return out, nil
+}
+
+func deleteMessage(ctx context.Context, q *queue, in *request) error {
+	if in.ReceiptHandle == "" {
+		return missingParameter("ReceiptHandle")
+	}
+	if err := q.Ack(ctx, &sqsd.Message{ReceiptHandle: in.ReceiptHandle}); err != nil {
+		return receiptHandleIsInvalid(in.ReceiptHandle)
+	}
+	return nil
+}
+
+func (s *Server) changeMessageVisibility(r *http.Request, in *request) (interface{}, error) {
+	q, err := s.queue(in)
+	if err != nil {
+		return nil, err
+	}
+	if in.ReceiptHandle == "" {
+		return nil, missingParameter("ReceiptHandle")
+	}
+	if in.VisibilityTimeout == nil {
+		return nil, missingParameter("VisibilityTimeout")
+	}
+	if err := validateVisibilityTimeout(*in.VisibilityTimeout); err != nil {
+		return nil, err
+	}
+
+	msg := &sqsd.Message{ReceiptHandle: in.ReceiptHandle}
+	if err := q.Nack(r.Context(), msg, time.Duration(*in.VisibilityTimeout)*time.Second); err != nil {
+		return nil, receiptHandleIsInvalid(in.ReceiptHandle)
+	}
+	return nil, nil
+}
+
+func validateVisibilityTimeout(timeout int) error {
+	if timeout < 0 || timeout > maxVisibilityTimeout {
+		return invalidParameter("Value %d for parameter VisibilityTimeout is invalid. Reason: must be between 0 and %d.", timeout, maxVisibilityTimeout)
+	}
+	return nil
+}
+
+func validateBatch(entries []*request) error {
+	if len(entries) == 0 {
+		return &apiError{
+			status:  http.StatusBadRequest,
+			code:    "AWS.SimpleQueueService.EmptyBatchRequest",
+			message: "There should be at least one entry in the request.",
+		}
+	}
+	if len(entries) > maxBatchEntries {
+		return &apiError{
+			status:  http.StatusBadRequest,
+			code:    "AWS.SimpleQueueService.TooManyEntriesInBatchRequest",
+			message: fmt.Sprintf("Maximum number of entries per request are %d. You have sent %d.", maxBatchEntries, len(entries)),
+		}
+	}
+
+	ids := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !batchEntryIDRegexp.MatchString(entry.ID) {
+			return &apiError{
+				status:  http.StatusBadRequest,
+				code:    "AWS.SimpleQueueService.InvalidBatchEntryId",
+				message: "A batch entry id can only contain alphanumeric characters, hyphens and underscores. It can be at most 80 letters long.",
+			}
+		}
+		if ids[entry.ID] {
+			return &apiError{
+				status:  http.StatusBadRequest,
+				code:    "AWS.SimpleQueueService.BatchEntryIdsNotDistinct",
+				message: fmt.Sprintf("Id %s repeated.", entry.ID),
+			}
+		}
+		ids[entry.ID] = true
+	}
+	return nil
+}
+
+func batchError(entry *request, err error) *batchResultErrorEntry {
+	e := &batchResultErrorEntry{ID: entry.ID, Code: "InternalError", Message: err.Error()}
+	if apiErr, ok := err.(*apiError); ok {
+		e.Code = apiErr.code
+		e.Message = apiErr.message
+		e.SenderFault = apiErr.faultType() == "Sender"
+	}
+	return e
+}
+
+func receiptHandleIsInvalid(handle string) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "ReceiptHandleIsInvalid",
+		message: fmt.Sprintf("The input receipt handle \"%s\" is not a valid receipt handle.", handle),
+	}
+}
+
+// selected reports whether name is requested by the list of names, All selects every name.
+// With prefixes, names ending in .* select all names starting with the part before .*
+func selected(name string, names []string, prefixes bool) bool {
+	for _, n := range names {
+		if n == "All" || n == name || (prefixes && n == ".*") {
+			return true
+		}
+		if prefixes && strings.HasSuffix(n, ".*") && strings.HasPrefix(name, n[:len(n)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSeconds(attr, val string, max int) (time.Duration, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 || n > max {
+		return 0, &apiError{
+			status:  http.StatusBadRequest,
+			code:    "InvalidAttributeValue",
+			message: fmt.Sprintf("Invalid value for the parameter %s, must be between 0 and %d.", attr, max),
+		}
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+func parseBool(attr, val string) (bool, error) {
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, &apiError{
+			status:  http.StatusBadRequest,
+			code:    "InvalidAttributeValue",
+			message: fmt.Sprintf("Invalid value for the parameter %s, must be true or false.", attr),
+		}
+	}
+	return b, nil
+}
+
+func md5Hex(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// md5OfMessageAttributes calculates the MD5OfMessageAttributes like SQS: the sorted attributes are encoded as
+// length prefixed name, length prefixed data type, a transport type byte (1 string, 2 binary) and length prefixed value
+func md5OfMessageAttributes(attrs map[string]*messageAttribute) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := md5.New()
+	writeValue := func(b []byte) {
+		binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	for _, name := range names {
+		attr := attrs[name]
+		writeValue([]byte(name))
+		writeValue([]byte(attr.DataType))
+		if strings.HasPrefix(attr.DataType, "Binary") {
+			h.Write([]byte{2})
+			writeValue(attr.BinaryValue)
+		} else {
+			h.Write([]byte{1})
+			writeValue([]byte(attr.StringValue))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func encodeBase64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
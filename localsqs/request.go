@@ -0,0 +1,159 @@
+package localsqs
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// request holds the parameters of all supported actions, the field names are the JSON protocol names.
+// Batch entries are requests too.
+type request struct {
+	QueueURL                    string `json:"QueueUrl"`
+	QueueName                   string
+	ID                          string `json:"Id"`
+	MessageBody                 string
+	DelaySeconds                *int
+	MessageAttributes           map[string]*messageAttribute
+	MaxNumberOfMessages         *int
+	WaitTimeSeconds             *int
+	VisibilityTimeout           *int
+	AttributeNames              []string
+	MessageSystemAttributeNames []string
+	MessageAttributeNames       []string
+	ReceiptHandle               string
+	MessageGroupID              string `json:"MessageGroupId"`
+	MessageDeduplicationID      string `json:"MessageDeduplicationId"`
+	Attributes                  map[string]string
+	Entries                     []*request
+}
+
+// batchEntryPrefixes are the query parameter prefixes of batch entries
+var batchEntryPrefixes = []string{"SendMessageBatchRequestEntry", "DeleteMessageBatchRequestEntry"}
+
+// decodeQuery decodes the parameters of the query protocol and returns the action
+func decodeQuery(r *http.Request, in *request) (string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", invalidParameter("Invalid request: %s", err)
+	}
+	action := r.Form.Get("Action")
+	if action == "" {
+		return "", missingParameter("Action")
+	}
+	return action, decodeForm(r.Form, in)
+}
+
+func decodeForm(f url.Values, in *request) error {
+	in.QueueURL = f.Get("QueueUrl")
+	in.QueueName = f.Get("QueueName")
+	in.ID = f.Get("Id")
+	in.MessageBody = f.Get("MessageBody")
+	in.ReceiptHandle = f.Get("ReceiptHandle")
+	in.MessageGroupID = f.Get("MessageGroupId")
+	in.MessageDeduplicationID = f.Get("MessageDeduplicationId")
+
+	for name, v := range map[string]**int{
+		"DelaySeconds":        &in.DelaySeconds,
+		"MaxNumberOfMessages": &in.MaxNumberOfMessages,
+		"WaitTimeSeconds":     &in.WaitTimeSeconds,
+		"VisibilityTimeout":   &in.VisibilityTimeout,
+	} {
+		s := f.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return invalidParameter("Value %s for parameter %s is invalid.", s, name)
+		}
+		*v = &n
+	}
+
+	in.AttributeNames = formList(f, "AttributeName")
+	in.MessageSystemAttributeNames = formList(f, "MessageSystemAttributeName")
+	in.MessageAttributeNames = formList(f, "MessageAttributeName")
+
+	for _, attr := range formIndexed(f, "Attribute") {
+		if in.Attributes == nil {
+			in.Attributes = make(map[string]string)
+		}
+		in.Attributes[attr.Get("Name")] = attr.Get("Value")
+	}
+
+	for _, attr := range formIndexed(f, "MessageAttribute") {
+		if in.MessageAttributes == nil {
+			in.MessageAttributes = make(map[string]*messageAttribute)
+		}
+		a := &messageAttribute{
+			DataType:    attr.Get("Value.DataType"),
+			StringValue: attr.Get("Value.StringValue"),
+		}
+		if b := attr.Get("Value.BinaryValue"); b != "" {
+			var err error
+			if a.BinaryValue, err = base64.StdEncoding.DecodeString(b); err != nil {
+				return invalidParameter("The binary value of message attribute %s is not base64 encoded.", attr.Get("Name"))
+			}
+		}
+		in.MessageAttributes[attr.Get("Name")] = a
+	}
+
+	for _, prefix := range batchEntryPrefixes {
+		for _, entry := range formIndexed(f, prefix) {
+			e := new(request)
+			if err := decodeForm(entry, e); err != nil {
+				return err
+			}
+			in.Entries = append(in.Entries, e)
+		}
+	}
+	return nil
+}
+
+// formIndexed returns the parameters starting with prefix.N. in order of N, with prefix.N. removed
+func formIndexed(f url.Values, prefix string) []url.Values {
+	groups := make(map[int]url.Values)
+	for key, values := range f {
+		if !strings.HasPrefix(key, prefix+".") {
+			continue
+		}
+		rest := key[len(prefix)+1:]
+		var sub string
+		if i := strings.Index(rest, "."); i >= 0 {
+			rest, sub = rest[:i], rest[i+1:]
+		}
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			continue
+		}
+		if groups[n] == nil {
+			groups[n] = make(url.Values)
+		}
+		groups[n][sub] = values
+	}
+
+	indexes := make([]int, 0, len(groups))
+	for n := range groups {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+
+	list := make([]url.Values, len(indexes))
+	for i, n := range indexes {
+		list[i] = groups[n]
+	}
+	return list
+}
+
+// formList returns the values of the parameters prefix.N in order of N
+func formList(f url.Values, prefix string) []string {
+	var list []string
+	for _, v := range formIndexed(f, prefix) {
+		if s := v.Get(""); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,394 @@
+package localsqs
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/sqsd"
+)
+
+const (
+	// accountID is the AWS account id used in queue URLs and ARNs
+	accountID = "000000000000"
+
+	// defaultVisibilityTimeout is the visibility timeout of new queues, the same as SQS
+	defaultVisibilityTimeout = 30 * time.Second
+
+	xmlNamespace     = "http://queue.amazonaws.com/doc/2012-11-05/"
+	jsonTargetPrefix = "AmazonSQS."
+	jsonContentType  = "application/x-amz-json-1.0"
+)
+
+// queueNameRegexp matches queue names, the names of FIFO queues end with .fifo
+var queueNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,80}$|^[a-zA-Z0-9_-]{1,75}\.fifo$`)
+
+// Server serves a subset of the Amazon SQS API using in-memory queues, so producers using an AWS SDK
+// can queue messages without AWS. Both the query (XML) and the JSON protocol are supported for the actions
+// SendMessage, SendMessageBatch, ReceiveMessage, DeleteMessage, DeleteMessageBatch, ChangeMessageVisibility,
+// GetQueueUrl, CreateQueue and GetQueueAttributes.
+// Requests are not authenticated, any credentials can be used.
+type Server struct {
+	// URL is the base of queue URLs, like http://localhost:9324, the host of the request is used when empty
+	URL string
+	// Region is used in queue ARNs
+	Region string
+	// Logger receives the log entries of the server, all are debug entries. Nothing is logged when it is nil.
+	Logger logging.Logger
+
+	mu     sync.Mutex
+	queues map[string]*queue
+}
+
+type queue struct {
+	*sqsd.MemorySource
+	created    time.Time
+	delay      time.Duration
+	waitTime   time.Duration
+	attributes map[string]string
+}
+
+// NewServer returns a Server without queues
+func NewServer() *Server {
+	return &Server{
+		Region: "us-east-1",
+		queues: make(map[string]*queue),
+	}
+}
+
+func (s *Server) debug(msg string, fields ...logging.Field) {
+	if s.Logger != nil {
+		logging.Debug(s.Logger, msg, fields...)
+	}
+}
+
+// CreateQueue creates a queue with the SQS queue attributes VisibilityTimeout, DelaySeconds,
+// ReceiveMessageWaitTimeSeconds, FifoQueue and ContentBasedDeduplication, other attributes are only stored.
+// The name of a FIFO queue must end with .fifo. An existing queue is returned unchanged.
+// The queue can be used as sqsd.Source to deliver its messages.
+func (s *Server) CreateQueue(name string, attributes map[string]string) (*sqsd.MemorySource, error) {
+	q, err := s.createQueue(name, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return q.MemorySource, nil
+}
+
+func (s *Server) createQueue(name string, attributes map[string]string) (*queue, error) {
+	if !queueNameRegexp.MatchString(name) {
+		return nil, invalidParameter("Can only include alphanumeric characters, hyphens, or underscores. 1 to 80 in length")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if q := s.queues[name]; q != nil {
+		return q, nil
+	}
+
+	q := &queue{
+		MemorySource: sqsd.NewMemorySource(name, defaultVisibilityTimeout),
+		created:      time.Now(),
+		attributes: map[string]string{
+			"MaximumMessageSize":     strconv.Itoa(maxMessageSize),
+			"MessageRetentionPeriod": "345600",
+		},
+	}
+	for attr, val := range attributes {
+		var err error
+		switch attr {
+		case "VisibilityTimeout":
+			q.VisibilityTimeout, err = parseSeconds(attr, val, maxVisibilityTimeout)
+		case "DelaySeconds":
+			q.delay, err = parseSeconds(attr, val, maxDelaySeconds)
+		case "ReceiveMessageWaitTimeSeconds":
+			q.waitTime, err = parseSeconds(attr, val, maxWaitTimeSeconds)
+		case "FifoQueue":
+			q.FIFO, err = parseBool(attr, val)
+			q.attributes[attr] = val
+		case "ContentBasedDeduplication":
+			q.ContentBasedDeduplication, err = parseBool(attr, val)
+			q.attributes[attr] = val
+		default:
+			q.attributes[attr] = val
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if q.FIFO != strings.HasSuffix(name, ".fifo") {
+		return nil, invalidParameter("The name of a FIFO queue must end with the .fifo suffix and FifoQueue must be true for it")
+	}
+
+	s.queues[name] = q
+	s.debug("queue created", logging.F(logging.FieldQueue, name))
+	return q, nil
+}
+
+// lookup returns the queue with name, or a NonExistentQueue error
+func (s *Server) lookup(name string) (*queue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queues[name]
+	if q == nil {
+		return nil, &apiError{
+			status:   http.StatusBadRequest,
+			code:     "AWS.SimpleQueueService.NonExistentQueue",
+			jsonType: "com.amazonaws.sqs#QueueDoesNotExist",
+			message:  "The specified queue does not exist.",
+		}
+	}
+	return q, nil
+}
+
+func (s *Server) queueURL(r *http.Request, name string) string {
+	base := s.URL
+	if base == "" {
+		base = "http://" + r.Host
+	}
+	return strings.TrimSuffix(base, "/") + "/" + accountID + "/" + name
+}
+
+func (s *Server) queueARN(name string) string {
+	return "arn:aws:sqs:" + s.Region + ":" + accountID + ":" + name
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := newRequestID()
+
+	var (
+		action string
+		in     = new(request)
+		err    error
+	)
+
+	target := r.Header.Get("X-Amz-Target")
+	jsonProtocol := strings.HasPrefix(target, jsonTargetPrefix)
+	if jsonProtocol {
+		action = strings.TrimPrefix(target, jsonTargetPrefix)
+		if err = json.NewDecoder(r.Body).Decode(in); err != nil {
+			err = &apiError{status: http.StatusBadRequest, code: "SerializationException", message: err.Error()}
+		}
+	} else {
+		action, err = decodeQuery(r, in)
+	}
+
+	var out interface{}
+	if err == nil {
+		s.debug("SQS API request", logging.F("action", action), logging.F("queue_url", in.QueueURL))
+		if do, ok := actions[action]; ok {
+			out, err = do(s, r, in)
+		} else {
+			err = &apiError{
+				status:   http.StatusBadRequest,
+				code:     "AWS.SimpleQueueService.UnsupportedOperation",
+				jsonType: "com.amazonaws.sqs#UnsupportedOperation",
+				message:  fmt.Sprintf("The action %s is not supported.", action),
+			}
+		}
+	}
+
+	if err != nil {
+		apiErr, ok := err.(*apiError)
+		if !ok {
+			apiErr = &apiError{status: http.StatusInternalServerError, code: "InternalError", message: err.Error()}
+		}
+		s.debug("SQS API error", logging.F("action", action), logging.Err(apiErr))
+		if jsonProtocol {
+			writeJSONError(w, apiErr)
+		} else {
+			writeXMLError(w, requestID, apiErr)
+		}
+		return
+	}
+
+	if jsonProtocol {
+		writeJSON(w, out)
+	} else {
+		writeXML(w, action, requestID, out)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, out interface{}) {
+	if out == nil {
+		out = struct{}{}
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(out)
+}
+
+func writeJSONError(w http.ResponseWriter, err *apiError) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("X-Amzn-Query-Error", err.code+";"+err.faultType())
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"__type":  err.typeName(),
+		"message": err.message,
+	})
+}
+
+// writeXML writes the response of the query protocol: <ActionResponse><ActionResult>out</ActionResult><ResponseMetadata>
+func writeXML(w http.ResponseWriter, action, requestID string, out interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(xml.Header))
+
+	e := xml.NewEncoder(w)
+	start := xml.StartElement{
+		Name: xml.Name{Local: action + "Response"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: xmlNamespace}},
+	}
+	e.EncodeToken(start)
+	if out != nil {
+		e.EncodeElement(out, xml.StartElement{Name: xml.Name{Local: action + "Result"}})
+	}
+	e.EncodeElement(&responseMetadata{RequestID: requestID}, xml.StartElement{Name: xml.Name{Local: "ResponseMetadata"}})
+	e.EncodeToken(start.End())
+	e.Flush()
+}
+
+type responseMetadata struct {
+	RequestID string `xml:"RequestId"`
+}
+
+func writeXMLError(w http.ResponseWriter, requestID string, err *apiError) {
+	resp := &xmlErrorResponse{RequestID: requestID}
+	resp.Error.Type = err.faultType()
+	resp.Error.Code = err.code
+	resp.Error.Message = err.message
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(err.status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(resp)
+}
+
+type xmlErrorResponse struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Error   struct {
+		Type    string
+		Code    string
+		Message string
+	}
+	RequestID string `xml:"RequestId"`
+}
+
+// apiError is an error returned to the client with its SQS error code
+type apiError struct {
+	status int
+	// code is the error code of the query protocol, jsonType the type of the JSON protocol,
+	// which is derived from code when empty
+	code     string
+	jsonType string
+	message  string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func (e *apiError) faultType() string {
+	if e.status >= 500 {
+		return "Receiver"
+	}
+	return "Sender"
+}
+
+func (e *apiError) typeName() string {
+	if e.jsonType != "" {
+		return e.jsonType
+	}
+	return "com.amazonaws.sqs#" + strings.TrimPrefix(e.code, "AWS.SimpleQueueService.")
+}
+
+func invalidParameter(format string, args ...interface{}) *apiError {
+	return &apiError{status: http.StatusBadRequest, code: "InvalidParameterValue", message: fmt.Sprintf(format, args...)}
+}
+
+func missingParameter(name string) *apiError {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "MissingParameter",
+		message: fmt.Sprintf("The request must contain the parameter %s.", name),
+	}
+}
+
+// attributeMap is marshalled to XML as a flattened list of Name and Value elements, like the SQS query protocol
+type attributeMap map[string]string
+
+func (m attributeMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	for _, name := range sortedKeys(m) {
+		attr := struct {
+			Name  string
+			Value string
+		}{name, m[name]}
+		if err := e.EncodeElement(&attr, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageAttributeMap is marshalled to XML as a flattened list of Name and Value elements, like the SQS query protocol
+type messageAttributeMap map[string]*messageAttribute
+
+func (m messageAttributeMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		attr := struct {
+			Name  string
+			Value *messageAttribute
+		}{name, m[name]}
+		if err := e.EncodeElement(&attr, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type messageAttribute struct {
+	DataType    string
+	StringValue string `json:",omitempty" xml:",omitempty"`
+	// BinaryValue is base64 encoded in both protocols
+	BinaryValue []byte `json:",omitempty" xml:"-"`
+}
+
+func (a *messageAttribute) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	v := struct {
+		DataType    string
+		StringValue string `xml:",omitempty"`
+		BinaryValue string `xml:",omitempty"`
+	}{a.DataType, a.StringValue, ""}
+	if len(a.BinaryValue) > 0 {
+		v.BinaryValue = encodeBase64(a.BinaryValue)
+	}
+	return e.EncodeElement(&v, start)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
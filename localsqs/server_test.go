@@ -0,0 +1,515 @@
+package localsqs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/jsonrpc"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// protocols runs every test with the query protocol the SDK uses and with the JSON protocol of newer SDKs
+var protocols = []struct {
+	name string
+	json bool
+	// nonExistentQueue is the error code of a missing queue
+	nonExistentQueue string
+}{
+	{name: "query", nonExistentQueue: sqs.ErrCodeQueueDoesNotExist},
+	{name: "json", json: true, nonExistentQueue: "QueueDoesNotExist"},
+}
+
+func forEachProtocol(t *testing.T, test func(t *testing.T, c *sqs.SQS)) {
+	for _, p := range protocols {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			srv := httptest.NewServer(NewServer())
+			defer srv.Close()
+			test(t, newTestClient(t, srv.URL, p.json))
+		})
+	}
+}
+
+func newTestClient(t *testing.T, url string, jsonProtocol bool) *sqs.SQS {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(url),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		DisableSSL:  aws.Bool(true),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := sqs.New(sess)
+	if jsonProtocol {
+		useJSONProtocol(c)
+	}
+	return c
+}
+
+// useJSONProtocol makes c use the SQS JSON protocol, the SDK only supports the query protocol for SQS.
+// The field names of the SDK types are the member names of the JSON protocol.
+func useJSONProtocol(c *sqs.SQS) {
+	c.Handlers.Build.RemoveByName(query.BuildHandler.Name)
+	c.Handlers.Build.PushBackNamed(awsrequest.NamedHandler{Name: "localsqs.test.Build", Fn: func(r *awsrequest.Request) {
+		body, err := json.Marshal(r.Params)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed encoding JSON request", err)
+			return
+		}
+		r.SetBufferBody(body)
+		r.HTTPRequest.Header.Set("X-Amz-Target", jsonTargetPrefix+r.Operation.Name)
+		r.HTTPRequest.Header.Set("Content-Type", jsonContentType)
+	}})
+	c.Handlers.Unmarshal.RemoveByName(query.UnmarshalHandler.Name)
+	c.Handlers.Unmarshal.PushBackNamed(awsrequest.NamedHandler{Name: "localsqs.test.Unmarshal", Fn: func(r *awsrequest.Request) {
+		defer r.HTTPResponse.Body.Close()
+		if err := json.NewDecoder(r.HTTPResponse.Body).Decode(r.Data); err != nil {
+			r.Error = awserr.New("SerializationError", "failed decoding JSON response", err)
+		}
+	}})
+	c.Handlers.UnmarshalMeta.RemoveByName(query.UnmarshalMetaHandler.Name)
+	c.Handlers.UnmarshalMeta.PushBackNamed(jsonrpc.UnmarshalMetaHandler)
+	c.Handlers.UnmarshalError.RemoveByName(query.UnmarshalErrorHandler.Name)
+	c.Handlers.UnmarshalError.PushBackNamed(jsonrpc.UnmarshalErrorHandler)
+}
+
+func createQueue(t *testing.T, c *sqs.SQS, name string, attributes map[string]string) string {
+	t.Helper()
+	out, err := c.CreateQueue(&sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: aws.StringMap(attributes),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(out.QueueUrl)
+}
+
+func sendMessage(t *testing.T, c *sqs.SQS, in *sqs.SendMessageInput) *sqs.SendMessageOutput {
+	t.Helper()
+	out, err := c.SendMessage(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func receiveMessages(t *testing.T, c *sqs.SQS, queueURL string, max int64) []*sqs.Message {
+	t.Helper()
+	out, err := c.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(queueURL),
+		MaxNumberOfMessages:   aws.Int64(max),
+		AttributeNames:        aws.StringSlice([]string{"All"}),
+		MessageAttributeNames: aws.StringSlice([]string{"All"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Messages
+}
+
+func receiveOne(t *testing.T, c *sqs.SQS, queueURL string) *sqs.Message {
+	t.Helper()
+	msgs := receiveMessages(t, c, queueURL, 1)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, received %d", len(msgs))
+	}
+	return msgs[0]
+}
+
+func receiveCount(t *testing.T, msg *sqs.Message) int {
+	t.Helper()
+	n, err := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	if err != nil {
+		t.Fatalf("invalid ApproximateReceiveCount: %s", err)
+	}
+	return n
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// attributesMD5 calculates MD5OfMessageAttributes as documented by AWS, independent of the server:
+// per attribute, sorted by name, the length prefixed name, data type and value, with transport type 1
+// for String and Number values and 2 for Binary values.
+func attributesMD5(attributes map[string]*sqs.MessageAttributeValue) string {
+	var names []string
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	writeValue := func(b []byte) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	for _, name := range names {
+		attr := attributes[name]
+		writeValue([]byte(name))
+		writeValue([]byte(aws.StringValue(attr.DataType)))
+		if attr.BinaryValue != nil {
+			buf.WriteByte(2)
+			writeValue(attr.BinaryValue)
+		} else {
+			buf.WriteByte(1)
+			writeValue([]byte(aws.StringValue(attr.StringValue)))
+		}
+	}
+	sum := md5.Sum(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMessageAttributes(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, c *sqs.SQS) {
+		queueURL := createQueue(t, c, "attributes", nil)
+
+		attributes := map[string]*sqs.MessageAttributeValue{
+			"Name":     {DataType: aws.String("String"), StringValue: aws.String("value with spaces")},
+			"Count":    {DataType: aws.String("Number"), StringValue: aws.String("42")},
+			"Payload":  {DataType: aws.String("Binary"), BinaryValue: []byte{0, 1, 2, 255}},
+			"Encoding": {DataType: aws.String("String.utf8"), StringValue: aws.String("ü")},
+		}
+		want := attributesMD5(attributes)
+
+		// the SDK fails the request when MD5OfMessageBody does not match
+		sent := sendMessage(t, c, &sqs.SendMessageInput{
+			QueueUrl:          aws.String(queueURL),
+			MessageBody:       aws.String("body"),
+			MessageAttributes: attributes,
+		})
+		if got := aws.StringValue(sent.MD5OfMessageAttributes); got != want {
+			t.Errorf("expected MD5OfMessageAttributes %s on send, got %s", want, got)
+		}
+
+		batch, err := c.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: []*sqs.SendMessageBatchRequestEntry{
+				{Id: aws.String("a"), MessageBody: aws.String("batch body"), MessageAttributes: attributes},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch.Successful) != 1 || aws.StringValue(batch.Successful[0].MD5OfMessageAttributes) != want {
+			t.Errorf("expected a batch entry with MD5OfMessageAttributes %s, got %v", want, batch)
+		}
+
+		msgs := receiveMessages(t, c, queueURL, 10)
+		if len(msgs) != 2 {
+			t.Fatalf("expected 2 messages, received %d", len(msgs))
+		}
+		for _, msg := range msgs {
+			if !reflect.DeepEqual(msg.MessageAttributes, attributes) {
+				t.Errorf("expected message attributes %v, got %v", attributes, msg.MessageAttributes)
+			}
+			if got := aws.StringValue(msg.MD5OfMessageAttributes); got != want {
+				t.Errorf("expected MD5OfMessageAttributes %s on receive, got %s", want, got)
+			}
+		}
+
+		_, err = c.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueURL),
+			MessageBody: aws.String("body"),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"Invalid": {DataType: aws.String("Date"), StringValue: aws.String("today")},
+			},
+		})
+		if errorCode(err) == "" {
+			t.Errorf("expected an error for an invalid data type, got %v", err)
+		}
+	})
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, c *sqs.SQS) {
+		queueURL := createQueue(t, c, "visibility", map[string]string{"VisibilityTimeout": "1"})
+		sendMessage(t, c, &sqs.SendMessageInput{QueueUrl: aws.String(queueURL), MessageBody: aws.String("body")})
+
+		first := receiveOne(t, c, queueURL)
+		if n := receiveCount(t, first); n != 1 {
+			t.Errorf("expected ApproximateReceiveCount 1, got %d", n)
+		}
+		if msgs := receiveMessages(t, c, queueURL, 10); len(msgs) != 0 {
+			t.Fatalf("expected no messages while the message is invisible, received %d", len(msgs))
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+
+		second := receiveOne(t, c, queueURL)
+		if aws.StringValue(second.MessageId) != aws.StringValue(first.MessageId) {
+			t.Errorf("expected message %s again, got %s", aws.StringValue(first.MessageId), aws.StringValue(second.MessageId))
+		}
+		if n := receiveCount(t, second); n != 2 {
+			t.Errorf("expected ApproximateReceiveCount 2, got %d", n)
+		}
+
+		_, err := c.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(queueURL), ReceiptHandle: first.ReceiptHandle})
+		if errorCode(err) != sqs.ErrCodeReceiptHandleIsInvalid {
+			t.Errorf("expected %s deleting with an expired receipt handle, got %v", sqs.ErrCodeReceiptHandleIsInvalid, err)
+		}
+		_, err = c.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(queueURL), ReceiptHandle: second.ReceiptHandle})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestChangeMessageVisibility(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, c *sqs.SQS) {
+		queueURL := createQueue(t, c, "change-visibility", nil)
+		sendMessage(t, c, &sqs.SendMessageInput{QueueUrl: aws.String(queueURL), MessageBody: aws.String("body")})
+
+		msg := receiveOne(t, c, queueURL)
+		_, err := c.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(queueURL),
+			ReceiptHandle:     msg.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg = receiveOne(t, c, queueURL)
+		if n := receiveCount(t, msg); n != 2 {
+			t.Errorf("expected ApproximateReceiveCount 2, got %d", n)
+		}
+
+		_, err = c.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(queueURL),
+			ReceiptHandle:     msg.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(43201),
+		})
+		if errorCode(err) != "InvalidParameterValue" {
+			t.Errorf("expected InvalidParameterValue for a visibility timeout over 12 hours, got %v", err)
+		}
+
+		_, err = c.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(queueURL),
+			ReceiptHandle:     aws.String("unknown"),
+			VisibilityTimeout: aws.Int64(0),
+		})
+		if errorCode(err) != sqs.ErrCodeReceiptHandleIsInvalid {
+			t.Errorf("expected %s for an unknown receipt handle, got %v", sqs.ErrCodeReceiptHandleIsInvalid, err)
+		}
+	})
+}
+
+func TestDeleteMessageBatchPartialFailure(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, c *sqs.SQS) {
+		queueURL := createQueue(t, c, "delete-batch", nil)
+		for _, body := range []string{"1", "2"} {
+			sendMessage(t, c, &sqs.SendMessageInput{QueueUrl: aws.String(queueURL), MessageBody: aws.String(body)})
+		}
+		msgs := receiveMessages(t, c, queueURL, 10)
+		if len(msgs) != 2 {
+			t.Fatalf("expected 2 messages, received %d", len(msgs))
+		}
+
+		out, err := c.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: []*sqs.DeleteMessageBatchRequestEntry{
+				{Id: aws.String("a"), ReceiptHandle: msgs[0].ReceiptHandle},
+				{Id: aws.String("b"), ReceiptHandle: aws.String("unknown")},
+				{Id: aws.String("c"), ReceiptHandle: msgs[1].ReceiptHandle},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var successful []string
+		for _, e := range out.Successful {
+			successful = append(successful, aws.StringValue(e.Id))
+		}
+		sort.Strings(successful)
+		if !reflect.DeepEqual(successful, []string{"a", "c"}) {
+			t.Errorf("expected entries a and c to succeed, got %v", successful)
+		}
+		if len(out.Failed) != 1 {
+			t.Fatalf("expected 1 failed entry, got %d", len(out.Failed))
+		}
+		failed := out.Failed[0]
+		if aws.StringValue(failed.Id) != "b" || aws.StringValue(failed.Code) != sqs.ErrCodeReceiptHandleIsInvalid || !aws.BoolValue(failed.SenderFault) {
+			t.Errorf("expected entry b to fail with %s as sender fault, got %v", sqs.ErrCodeReceiptHandleIsInvalid, failed)
+		}
+
+		attrs, err := c.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queueURL),
+			AttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"ApproximateNumberOfMessages", "ApproximateNumberOfMessagesNotVisible"} {
+			if got := aws.StringValue(attrs.Attributes[name]); got != "0" {
+				t.Errorf("expected %s 0 after the batch delete, got %s", name, got)
+			}
+		}
+
+		_, err = c.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: []*sqs.DeleteMessageBatchRequestEntry{
+				{Id: aws.String("a"), ReceiptHandle: aws.String("x")},
+				{Id: aws.String("a"), ReceiptHandle: aws.String("y")},
+			},
+		})
+		// the JSON protocol uses the error codes without the AWS.SimpleQueueService prefix
+		if !strings.HasSuffix(errorCode(err), "BatchEntryIdsNotDistinct") {
+			t.Errorf("expected BatchEntryIdsNotDistinct for duplicate ids, got %v", err)
+		}
+	})
+}
+
+func TestFIFOQueue(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, c *sqs.SQS) {
+		queueURL := createQueue(t, c, "jobs.fifo", map[string]string{"FifoQueue": "true"})
+
+		send := func(body, group, dedup string) *sqs.SendMessageOutput {
+			return sendMessage(t, c, &sqs.SendMessageInput{
+				QueueUrl:               aws.String(queueURL),
+				MessageBody:            aws.String(body),
+				MessageGroupId:         aws.String(group),
+				MessageDeduplicationId: aws.String(dedup),
+			})
+		}
+		a1 := send("a1", "a", "1")
+		send("a2", "a", "2")
+		send("b1", "b", "3")
+
+		duplicate := send("a1 again", "a", "1")
+		if aws.StringValue(duplicate.MessageId) != aws.StringValue(a1.MessageId) ||
+			aws.StringValue(duplicate.SequenceNumber) != aws.StringValue(a1.SequenceNumber) {
+			t.Errorf("expected the duplicate to return message %s, got %s", aws.StringValue(a1.MessageId), aws.StringValue(duplicate.MessageId))
+		}
+
+		msg := receiveOne(t, c, queueURL)
+		if body := aws.StringValue(msg.Body); body != "a1" {
+			t.Fatalf("expected the first message of group a, got %s", body)
+		}
+		if got := aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]); got != "a" {
+			t.Errorf("expected MessageGroupId a, got %s", got)
+		}
+		if got := aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSequenceNumber]); got != aws.StringValue(a1.SequenceNumber) {
+			t.Errorf("expected SequenceNumber %s, got %s", aws.StringValue(a1.SequenceNumber), got)
+		}
+
+		// group a is blocked while a1 is in flight
+		msgs := receiveMessages(t, c, queueURL, 10)
+		if len(msgs) != 1 || aws.StringValue(msgs[0].Body) != "b1" {
+			t.Fatalf("expected only b1 while a1 is in flight, got %v", msgs)
+		}
+
+		if _, err := c.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(queueURL), ReceiptHandle: msg.ReceiptHandle}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := receiveOne(t, c, queueURL); aws.StringValue(msg.Body) != "a2" {
+			t.Errorf("expected a2 after deleting a1, got %s", aws.StringValue(msg.Body))
+		}
+
+		_, err := c.SendMessage(&sqs.SendMessageInput{QueueUrl: aws.String(queueURL), MessageBody: aws.String("no group")})
+		if errorCode(err) != "MissingParameter" {
+			t.Errorf("expected MissingParameter without MessageGroupId, got %v", err)
+		}
+		_, err = c.SendMessage(&sqs.SendMessageInput{QueueUrl: aws.String(queueURL), MessageBody: aws.String("no dedup"), MessageGroupId: aws.String("a")})
+		if errorCode(err) != "InvalidParameterValue" {
+			t.Errorf("expected InvalidParameterValue without MessageDeduplicationId, got %v", err)
+		}
+	})
+}
+
+func TestFIFOQueueContentBasedDeduplication(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, c *sqs.SQS) {
+		queueURL := createQueue(t, c, "content.fifo", map[string]string{"FifoQueue": "true", "ContentBasedDeduplication": "true"})
+
+		var ids []string
+		for _, body := range []string{"same", "same", "other"} {
+			out := sendMessage(t, c, &sqs.SendMessageInput{
+				QueueUrl:       aws.String(queueURL),
+				MessageBody:    aws.String(body),
+				MessageGroupId: aws.String("g"),
+			})
+			ids = append(ids, aws.StringValue(out.MessageId))
+		}
+		if ids[0] != ids[1] || ids[0] == ids[2] {
+			t.Errorf("expected only the equal bodies to be deduplicated, got message ids %v", ids)
+		}
+
+		attrs, err := c.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queueURL),
+			AttributeNames: aws.StringSlice([]string{"ApproximateNumberOfMessages", "FifoQueue"}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aws.StringValue(attrs.Attributes["ApproximateNumberOfMessages"]); got != "2" {
+			t.Errorf("expected 2 messages, got %s", got)
+		}
+		if got := aws.StringValue(attrs.Attributes["FifoQueue"]); got != "true" {
+			t.Errorf("expected FifoQueue true, got %s", got)
+		}
+	})
+}
+
+func TestCreateFIFOQueueValidatesName(t *testing.T) {
+	forEachProtocol(t, func(t *testing.T, c *sqs.SQS) {
+		for name, attributes := range map[string]map[string]string{
+			"missing-attribute.fifo": nil,
+			"missing-suffix":         {"FifoQueue": "true"},
+		} {
+			_, err := c.CreateQueue(&sqs.CreateQueueInput{QueueName: aws.String(name), Attributes: aws.StringMap(attributes)})
+			if errorCode(err) != "InvalidParameterValue" {
+				t.Errorf("expected InvalidParameterValue creating queue %s, got %v", name, err)
+			}
+		}
+	})
+}
+
+func TestNonExistentQueue(t *testing.T) {
+	for _, p := range protocols {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			srv := httptest.NewServer(NewServer())
+			defer srv.Close()
+			c := newTestClient(t, srv.URL, p.json)
+
+			_, err := c.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String("missing")})
+			if errorCode(err) != p.nonExistentQueue {
+				t.Errorf("expected %s from GetQueueUrl, got %v", p.nonExistentQueue, err)
+			}
+			if rerr, ok := err.(awserr.RequestFailure); !ok || rerr.StatusCode() != 400 {
+				t.Errorf("expected a 400 request failure, got %v", err)
+			}
+
+			_, err = c.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    aws.String(srv.URL + "/" + accountID + "/missing"),
+				MessageBody: aws.String("body"),
+			})
+			if errorCode(err) != p.nonExistentQueue {
+				t.Errorf("expected %s from SendMessage, got %v", p.nonExistentQueue, err)
+			}
+		})
+	}
+}
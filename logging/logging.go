@@ -0,0 +1,261 @@
+// Package logging is the structured leveled logger of the daemon.
+//
+// Log entries have a level, a message and fields. They are written as text,
+// logfmt or JSON by Writer. Implement Logger to send them to your own logger.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// The log levels, Debug entries are only useful while developing or troubleshooting
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level" + strconv.Itoa(int(l))
+}
+
+// ParseLevel returns the level with name debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+}
+
+// Field is a key and value added to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// The field names used by the daemon
+const (
+	FieldMessageID    = "message_id"
+	FieldQueue        = "queue"
+	FieldReceiveCount = "receive_count"
+	FieldStatus       = "status"
+	FieldDuration     = "duration"
+	FieldError        = "error"
+	FieldTask         = "task"
+)
+
+// Err returns the error field of err
+func Err(err error) Field {
+	return F(FieldError, err)
+}
+
+// Logger receives the log entries of the daemon, implementations must be safe for concurrent use
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// Debug logs msg with level debug
+func Debug(l Logger, msg string, fields ...Field) { l.Log(LevelDebug, msg, fields...) }
+
+// Info logs msg with level info
+func Info(l Logger, msg string, fields ...Field) { l.Log(LevelInfo, msg, fields...) }
+
+// Warn logs msg with level warn
+func Warn(l Logger, msg string, fields ...Field) { l.Log(LevelWarn, msg, fields...) }
+
+// Error logs msg with level error
+func Error(l Logger, msg string, fields ...Field) { l.Log(LevelError, msg, fields...) }
+
+// With returns a Logger adding fields to every entry logged to l
+func With(l Logger, fields ...Field) Logger {
+	if w, ok := l.(*withLogger); ok {
+		return &withLogger{l: w.l, fields: append(append([]Field(nil), w.fields...), fields...)}
+	}
+	return &withLogger{l: l, fields: fields}
+}
+
+type withLogger struct {
+	l      Logger
+	fields []Field
+}
+
+func (w *withLogger) Log(level Level, msg string, fields ...Field) {
+	w.l.Log(level, msg, append(append([]Field(nil), w.fields...), fields...)...)
+}
+
+// Discard is a Logger that drops all entries
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Log(Level, string, ...Field) {}
+
+// Format is the output format of Writer
+type Format string
+
+// The formats of Writer, FormatText looks like the standard log package with the fields appended
+const (
+	FormatText   Format = "text"
+	FormatLogfmt Format = "logfmt"
+	FormatJSON   Format = "json"
+)
+
+// ParseFormat returns the format with name text, logfmt or json
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case FormatText, FormatLogfmt, FormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q, use text, logfmt or json", name)
+}
+
+// Writer is a Logger writing entries of Level or higher to an io.Writer, one line per entry
+type Writer struct {
+	Out    io.Writer
+	Format Format
+	Level  Level
+
+	mu sync.Mutex
+}
+
+// New returns a Writer
+func New(out io.Writer, format Format, level Level) *Writer {
+	return &Writer{Out: out, Format: format, Level: level}
+}
+
+// Default returns the logger used when none is configured, it writes text to stderr
+// with level info, or debug when verbose is true
+func Default(verbose bool) Logger {
+	level := LevelInfo
+	if verbose {
+		level = LevelDebug
+	}
+	return New(os.Stderr, FormatText, level)
+}
+
+// Log writes the entry when level is at least w.Level
+func (w *Writer) Log(level Level, msg string, fields ...Field) {
+	if level < w.Level {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	now := time.Now()
+	switch w.Format {
+	case FormatJSON:
+		writeJSON(buf, now, level, msg, fields)
+	case FormatLogfmt:
+		buf.WriteString("time=" + now.UTC().Format(time.RFC3339Nano))
+		buf.WriteString(" level=" + level.String())
+		buf.WriteString(" msg=" + logfmtValue(msg))
+		writeLogfmtFields(buf, fields)
+	default:
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(strings.ToUpper(level.String()) + " " + msg)
+		writeLogfmtFields(buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.Out.Write(buf.Bytes())
+}
+
+func writeLogfmtFields(buf *bytes.Buffer, fields []Field) {
+	for _, f := range fields {
+		buf.WriteString(" " + f.Key + "=" + logfmtValue(formatValue(f.Value)))
+	}
+}
+
+// logfmtValue quotes s when it is empty or contains spaces, quotes, = or control characters
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '"' || r == '=' || r == 0x7f }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatValue returns the text representation of a field value
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func writeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, now.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeJSONValue(buf, f.Key)
+		buf.WriteByte(':')
+		switch v := f.Value.(type) {
+		case error:
+			writeJSONValue(buf, v.Error())
+		case time.Duration:
+			// durations are written in seconds, like the metrics
+			writeJSONValue(buf, v.Seconds())
+		case time.Time:
+			writeJSONValue(buf, v.Format(time.RFC3339Nano))
+		case fmt.Stringer:
+			writeJSONValue(buf, v.String())
+		default:
+			writeJSONValue(buf, v)
+		}
+	}
+	buf.WriteByte('}')
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(formatValue(v))
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,189 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timestamps matches the time of text and logfmt entries
+var timestamps = regexp.MustCompile(`^(\d{4}/\d\d/\d\d \d\d:\d\d:\d\d |time=\S+ )`)
+
+// lines returns the lines written to buf without their timestamps
+func lines(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	var l []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if !timestamps.MatchString(line) {
+			t.Errorf("entry %q has no timestamp", line)
+		}
+		l = append(l, timestamps.ReplaceAllString(line, ""))
+	}
+	return l
+}
+
+func testFields() []Field {
+	return []Field{
+		F(FieldQueue, "jobs"),
+		F(FieldStatus, 500),
+		F(FieldDuration, 1500*time.Millisecond),
+		Err(errors.New("connection refused")),
+	}
+}
+
+func TestWriterFormats(t *testing.T) {
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{
+			format: FormatText,
+			want:   `WARN delivery failed queue=jobs status=500 duration=1.5s error="connection refused"`,
+		},
+		{
+			format: FormatLogfmt,
+			want:   `level=warn msg="delivery failed" queue=jobs status=500 duration=1.5s error="connection refused"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.format), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			Warn(New(buf, test.format, LevelDebug), "delivery failed", testFields()...)
+			if got := lines(t, buf); !reflect.DeepEqual(got, []string{test.want}) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriterJSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	Warn(New(buf, FormatJSON, LevelDebug), "delivery failed", testFields()...)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON %q: %s", buf.String(), err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Errorf("invalid time: %s", err)
+	}
+	delete(entry, "time")
+
+	want := map[string]interface{}{
+		"level":  "warn",
+		"msg":    "delivery failed",
+		"queue":  "jobs",
+		"status": float64(500),
+		// durations are in seconds
+		"duration": 1.5,
+		"error":    "connection refused",
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("got %v, want %v", entry, want)
+	}
+	if !strings.HasSuffix(buf.String(), "}\n") || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("entry %q is not a single line", buf.String())
+	}
+}
+
+func TestLogfmtQuoting(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{value: "plain", want: "plain"},
+		{value: "", want: `""`},
+		{value: "with space", want: `"with space"`},
+		{value: "a=b", want: `"a=b"`},
+		{value: `say "hi"`, want: `"say \"hi\""`},
+		{value: "line\nbreak", want: `"line\nbreak"`},
+		{value: "tab\there", want: `"tab\there"`},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		Info(New(buf, FormatLogfmt, LevelDebug), "msg", F("key", test.value))
+		want := "level=info msg=msg key=" + test.want
+		if got := lines(t, buf); !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("value %q: got %q, want %q", test.value, got, want)
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := New(buf, FormatLogfmt, LevelDebug)
+	parent := With(w, F("a", 1))
+	child := With(parent, F("b", 2))
+	With(parent, F("c", 3))
+
+	Info(child, "child", F("d", 4))
+	Info(parent, "parent")
+	Info(w, "root")
+
+	want := []string{
+		"level=info msg=child a=1 b=2 d=4",
+		"level=info msg=parent a=1",
+		"level=info msg=root",
+	}
+	if got := lines(t, buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWriterLevel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := New(buf, FormatLogfmt, LevelWarn)
+	Debug(w, "debug")
+	Info(w, "info")
+	Warn(w, "warn")
+	Error(w, "error")
+
+	want := []string{"level=warn msg=warn", "level=error msg=error"}
+	if got := lines(t, buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warning": LevelWarn, "Error": LevelError} {
+		if l, err := ParseLevel(name); err != nil || l != want {
+			t.Errorf("ParseLevel(%q) = %s, %v, want %s", name, l, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+// formatCounter counts how often it is formatted
+type formatCounter int
+
+func (c *formatCounter) String() string {
+	*c++
+	return "formatted"
+}
+
+func TestDiscard(t *testing.T) {
+	// Discard and loggers derived from it drop entries without formatting their fields
+	var c formatCounter
+	Error(Discard, "dropped", F("key", &c))
+	Info(With(Discard, F("key", &c)), "dropped", F("other", &c))
+	if c != 0 {
+		t.Errorf("fields formatted %d times", c)
+	}
+
+	buf := new(bytes.Buffer)
+	Info(New(buf, FormatText, LevelInfo), "written", F("key", &c))
+	if c != 1 || !strings.Contains(buf.String(), "key=formatted") {
+		t.Errorf("field formatted %d times in %q, want once", c, buf.String())
+	}
+}
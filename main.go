@@ -1,92 +1,331 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/awsconfig"
 	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/createqueue"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/localsqs"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
 	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/sqsd"
 )
 
+// exitDeliveriesAborted is the exit code used when in-flight deliveries were aborted at shutdown,
+// errors exit with code 1 and a clean shutdown with 0
+const exitDeliveriesAborted = 2
+
 func main() {
 
 	var (
 		flagSQSQueueURL        = flag.String("sqs-url", "", "The URL of the Amazon SQS queue from which messages are received. Use this or create-queue.")
 		flagCreateQueueName    = flag.String("sqs-create-queue", "", "Creates a queue with this name (use '[hostname]' as replacer for the local host name), subscribes it to the SNS topics listed in subscribe-to-sns-arns and then uses this queue to receive messages. Use this or sqs-url.")
+		flagSourceDir          = flag.String("source-dir", "", "Receive messages from the files in this directory instead of an Amazon SQS queue, for development without AWS. Delivered files are removed.")
+		flagLocal              = flag.Bool("local", false, "Use an in-memory queue instead of an Amazon SQS queue, for development without AWS. Messages are queued by POSTing them to local-addr.")
+		flagLocalAddr          = flag.String("local-addr", "localhost:9901", "The address the HTTP API to queue messages listens on when using local. The request body is the message body, X-Aws-Sqsd-Attr-<name> headers are message attributes and the delay query parameter sets the delay in seconds.")
+		flagLocalSQSAddr       = flag.String("local-sqs-addr", "", "When using local, also serve a subset of the Amazon SQS API on this address, so producers using an AWS SDK with this endpoint can send messages to the queue named 'local'.")
 		flagSubscribeToSNSARNs = flag.String("subscribe-to-sns-arns", "", "Comma separated list of SNS topic ARNs to subscribe the created queue to (for existing queues no new subscriptions will be added).")
 		flagHTTPURL            = flag.String("http-url", "http://localhost:9900/sqs", "The URL to the application that will receive the data from the Amazon SQS queue. The data is inserted into the message body of an HTTP POST message.")
+		flagHTTPPath           = flag.String("http-path", "", "The path of http-url to post messages to, like the HttpPath option of Elastic Beanstalk. Empty uses the path of http-url.")
 		flagMIMEType           = flag.String("mime-type", "application/json", " Indicate the MIME type that the HTTP POST message uses.")
 		flagHTTPTimeout        = flag.Uint("http-timeout", 30, "Timeout in seconds to wait for HTTP requests.")
-		flagVisibilityTimeout  = flag.Uint("visibility-timeout ", 60, "Indicate the amount of time, in seconds, an incoming message from the Amazon SQS queue is locked for processing. After the configured amount of time has passed, the message is again made visible in the queue for another daemon to read.")
+		flagConnectTimeout     = flag.Uint("connect-timeout", 5, "Timeout in seconds to wait for a connection to the HTTP endpoint. Use 0 to only apply http-timeout.")
+		flagVisibilityTimeout  = flag.Uint("visibility-timeout", 60, "Indicate the amount of time, in seconds, an incoming message from the Amazon SQS queue is locked for processing. After the configured amount of time has passed, the message is again made visible in the queue for another daemon to read.")
+		flagMaxJobDuration     = flag.Uint("max-job-duration", 0, "The maximum time, in seconds, a message can be processed. While waiting for the HTTP response the visibility-timeout of the message is extended, after this time the request is cancelled. Use 0 to not extend the visibility-timeout. The http-timeout still applies.")
 		flagConnections        = flag.Uint("connections", 50, "The maximum number of concurrent connections that the daemon can make to the HTTP endpoint.")
+		flagPollers            = flag.Uint("pollers", 0, "The number of concurrent long-polls to the Amazon SQS queue, each receiving up to 10 messages. Use 0 to start enough pollers to keep all connections busy.")
+		flagCronFile           = flag.String("cron-file", "", "Path to a cron.yaml file with periodic tasks. Each task is queued on its schedule and posted to its url relative to http-url.")
+		flagSuccessCodes       = flag.String("http-success-codes", "200", "Comma separated list of HTTP status codes that mean the message was delivered, ranges like 201-204 and classes like 2xx can be used.")
+		flagPermanentCodes     = flag.String("http-permanent-failure-codes", "", "Comma separated list of HTTP status codes, ranges or classes that mean the message can never be delivered, like 400,422. These messages are not retried but moved to the dead-letter queue or deleted.")
+		flagRetryableCodes     = flag.String("http-retryable-codes", "", "Comma separated list of HTTP status codes, ranges or classes that are retried, like 429,5xx. When set, all other unsuccessful codes are permanent failures. Empty retries all codes that are not a success or permanent failure.")
+		flagBackpressureCodes  = flag.String("http-backpressure-codes", "429,503", "Comma separated list of HTTP status codes, ranges or classes that mean the endpoint is overloaded. The message is retried after the Retry-After of the response and receiving messages is paused for that time. Use an empty list to treat them as other failures.")
+		flagBackpressureDelay  = flag.Uint("backpressure-delay", 10, "The time, in seconds, to retry a message and pause receiving after a response in http-backpressure-codes without a Retry-After header.")
+		flagBreakerThreshold   = flag.Uint("circuit-breaker-threshold", 0, "Open the circuit breaker after this many consecutive connection errors or 5xx responses of the HTTP endpoint, receiving messages is paused while it is open. Use 0 to disable the circuit breaker.")
+		flagBreakerTimeout     = flag.Uint("circuit-breaker-timeout", 30, "The time, in seconds, the circuit breaker stays open before a single message is delivered as probe. When the probe succeeds receiving continues, otherwise the circuit breaker opens again.")
+		flagHealthCheckURL     = flag.String("health-check-url", "", "A URL of the application that responds with a 2xx status code when it is healthy, messages are only received after it does. Use this or health-check-addr.")
+		flagHealthCheckAddr    = flag.String("health-check-addr", "", "A TCP address of the application, like localhost:8080, messages are only received after it accepts connections. Use this or health-check-url.")
+		flagHealthCheckTimeout = flag.Uint("health-check-timeout", 60, "The maximum time, in seconds, to wait for the application to become healthy at start, the daemon exits when it does not. Use 0 to wait forever.")
+		flagHealthCheckIntv    = flag.Uint("health-check-interval", 0, "Keep checking the health of the application every this many seconds after start and pause receiving messages while it is unhealthy. Use 0 to only check at start.")
+		flagErrorVisibility    = flag.Uint("error-visibility-timeout", 0, "The amount of time, in seconds, a message is locked after a failed delivery before it is retried. Use 0 to wait for the visibility-timeout.")
+		flagErrorBackoff       = flag.Bool("error-visibility-backoff", false, "Double the error-visibility-timeout for every time a message was received (exponential backoff).")
+		flagRetentionPeriod    = flag.Uint("retention-period", 345600, "Messages older than this amount of time, in seconds, are not delivered but moved to the dead-letter queue or deleted. Use 0 to deliver messages of any age.")
+		flagMaxRetries         = flag.Uint("max-retries", 0, "The maximum number of times a message is received before it is moved to the dead-letter queue. Use 0 to retry until the message retention period expires.")
+		flagDeadLetterQueueURL = flag.String("dead-letter-queue-url", "", "The URL of the Amazon SQS queue that messages exceeding max-retries are moved to.")
+		flagCreateDLQName      = flag.String("sqs-create-dead-letter-queue", "", "Creates a dead-letter queue with this name (use '[hostname]' as replacer for the local host name) together with sqs-create-queue, a newly created queue gets a redrive policy to it based on max-retries. Use this or dead-letter-queue-url.")
+		flagCreateFIFO         = flag.Bool("sqs-create-fifo-queue", false, "Create FIFO queues with sqs-create-queue and sqs-create-dead-letter-queue, .fifo is added to their names. Messages of a message group are delivered one at a time in order.")
+		flagContentDedup       = flag.Bool("sqs-content-based-deduplication", false, "Enable content-based deduplication on the FIFO queues created with sqs-create-fifo-queue, messages sent without a deduplication ID are deduplicated by a hash of their body.")
+		flagLeaderQueueURL     = flag.String("leader-queue-url", "", "The URL of a dedicated Amazon SQS FIFO queue used for leader election when multiple daemons use the same cron-file, only the leader queues the periodic tasks.")
+		flagShutdownTimeout    = flag.Uint("shutdown-timeout", 30, "The maximum time, in seconds, to wait for in-flight deliveries when stopping on SIGINT or SIGTERM. Unfinished deliveries are aborted and their messages are made visible again.")
+
+		flagAWSEndpoint    = flag.String("aws-endpoint", "", "The URL of the SQS and SNS API to use instead of the AWS endpoints, for local stand-ins like ElasticMQ or LocalStack.")
+		flagAWSRegion      = flag.String("aws-region", "", "The AWS region of the SQS queue, by default the region is read from the AWS_REGION environment variable or the shared config file.")
+		flagAWSProfile     = flag.String("aws-profile", "", "The named profile from the shared AWS credentials and config files to use.")
+		flagAWSPathStyle   = flag.Bool("aws-path-style", false, "Force path-style addressing for AWS services that support it, for local stand-ins that do not support virtual hosted-style addressing.")
+		flagAWSRoleARN     = flag.String("aws-role-arn", "", "The ARN of an IAM role to assume for all AWS API calls, for example to use a queue in another account. The temporary credentials are refreshed automatically.")
+		flagAWSExternalID  = flag.String("aws-external-id", "", "The external ID used when assuming aws-role-arn or a role from sns-role-arns.")
+		flagAWSSessionName = flag.String("aws-role-session-name", "aws-sqsd", "The session name used when assuming aws-role-arn or a role from sns-role-arns.")
+		flagAWSSTSEndpoint = flag.String("aws-sts-endpoint", "", "The URL of the STS API used to assume aws-role-arn and sns-role-arns, aws-endpoint is not used for STS. By default the AWS endpoint of the region is used.")
+		flagSNSRoleARNs    = flag.String("sns-role-arns", "", "Comma separated list of IAM role ARNs to assume when subscribing to SNS topics in other accounts, the role in the account of a topic is used for that topic.")
+
+		flagAdminAddr = flag.String("admin-addr", "", "The address of the admin HTTP listener serving /metrics in the Prometheus text format and the /healthz and /readyz checks, like localhost:9902. Disabled when empty.")
+
+		flagLogFormat = flag.String("log-format", "text", "The format of the log output: text, logfmt or json.")
+		flagLogLevel  = flag.String("log-level", "info", "The minimum level of logged entries: debug, info, warn or error.")
+		flagVerbose   = flag.Bool("v", false, "Log all the things, the same as log-level debug.")
 
-		flagVerbose = flag.Bool("v", false, "Log all the things.")
+		flagConfig       = flag.String("config", os.Getenv("SQSD_CONFIG"), "Path to a YAML or JSON config file with the settings by name, like VisibilityTimeout: 60. Every setting can also be set with an environment variable, -config-check lists all names. Flags take precedence over environment variables, which take precedence over the config file.")
+		flagEBExtensions = flag.String("ebextensions", os.Getenv("SQSD_EBEXTENSIONS"), "Path to a .ebextensions directory or config file to read the aws:elasticbeanstalk:sqsd option_settings from, so the settings of the deployed worker are used. The config file and environment variables take precedence.")
+		flagConfigCheck  = flag.Bool("config-check", false, "Print the effective configuration and exit, with code 1 when it is invalid.")
 	)
 
 	flag.Parse()
 
-	if *flagSQSQueueURL == "" {
-		*flagSQSQueueURL = os.Getenv("SQS_URL")
+	var configFiles []configValues
+	if *flagConfig != "" {
+		values, err := readConfigFile(*flagConfig)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		configFiles = append(configFiles, values)
+	}
+	var ebextensions configValues
+	if *flagEBExtensions != "" {
+		values, warnings, err := readEBExtensions(*flagEBExtensions)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		ebextensions = values
+		configFiles = append(configFiles, ebextensions)
+	}
+
+	sources, err := loadConfig(flag.CommandLine, configFiles...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ignoreDeployedQueue(flag.CommandLine, sources, ebextensions)
+	configErrs := validateConfig(flag.CommandLine)
+	if *flagConfigCheck {
+		printConfig(os.Stdout, flag.CommandLine, sources)
 	}
-	if *flagCreateQueueName == "" {
-		*flagCreateQueueName = os.Getenv("SQS_CREATE_QUEUE")
+	for _, err := range configErrs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(configErrs) > 0 {
+		os.Exit(1)
 	}
+	if *flagConfigCheck {
+		os.Exit(0)
+	}
+
+	logger := newLogger(*flagLogFormat, *flagLogLevel, *flagVerbose)
 
-	if strings.Contains(*flagCreateQueueName, "[hostname]") {
+	if strings.Contains(*flagCreateQueueName+*flagCreateDLQName, "[hostname]") {
 		hn, err := os.Hostname()
 		if err != nil {
-			log.Fatalf("cannot get local hostname: %s", err)
+			fatal(logger, "cannot get local hostname", err)
 		}
 		*flagCreateQueueName = strings.Replace(*flagCreateQueueName, "[hostname]", hn, -1)
+		*flagCreateDLQName = strings.Replace(*flagCreateDLQName, "[hostname]", hn, -1)
 	}
 
-	if *flagSQSQueueURL == "" && *flagCreateQueueName == "" {
-		flag.PrintDefaults()
-		os.Exit(1)
+	httpURL := *flagHTTPURL
+	if *flagHTTPPath != "" {
+		u, _ := url.Parse(httpURL)
+		u.Path, u.RawQuery = *flagHTTPPath, ""
+		httpURL = u.String()
+	}
+
+	awsConfig := awsconfig.Config{
+		Endpoint:        *flagAWSEndpoint,
+		Region:          *flagAWSRegion,
+		Profile:         *flagAWSProfile,
+		PathStyle:       *flagAWSPathStyle,
+		RoleARN:         *flagAWSRoleARN,
+		ExternalID:      *flagAWSExternalID,
+		RoleSessionName: *flagAWSSessionName,
+		STSEndpoint:     *flagAWSSTSEndpoint,
 	}
 
 	if *flagCreateQueueName != "" {
 		// create the queue and subscribe it first
 
-		queueARNs := strings.Split(*flagSubscribeToSNSARNs, ",")
-		if len(queueARNs) == 1 && len(queueARNs[0]) == 0 {
-			queueARNs = make([]string, 0)
-		}
+		queueARNs := splitList(*flagSubscribeToSNSARNs)
 
 		createOptions := &createqueue.CreateOptions{
 			QueueName:         *flagCreateQueueName,
 			SNSTopicARNs:      queueARNs,
 			VisibilityTimeout: int(*flagVisibilityTimeout),
-			Verbose:           *flagVerbose,
+			Logger:            logger,
+			AWS:               awsConfig,
+			SNSRoleARNs:       splitList(*flagSNSRoleARNs),
+
+			FIFO:                      *flagCreateFIFO,
+			ContentBasedDeduplication: *flagContentDedup,
+		}
+		if *flagCreateDLQName != "" {
+			createOptions.DeadLetterQueueName = *flagCreateDLQName
+			if *flagMaxRetries > 0 {
+				createOptions.MaxReceiveCount = int(*flagMaxRetries) + 1
+			}
 		}
-		var err error
 		*flagSQSQueueURL, err = createqueue.CreateAndSubscribe(createOptions)
 		if err != nil {
-			log.Fatal(err)
+			fatal(logger, "error creating queue", err)
+		}
+		if createOptions.DeadLetterQueueURL != "" {
+			*flagDeadLetterQueueURL = createOptions.DeadLetterQueueURL
 		}
 	}
 
 	// start the SQS daemon client
 	sqsDaemon := &sqsd.Client{
-		SQSQueueURL:       *flagSQSQueueURL,
-		HTTPURL:           *flagHTTPURL,
-		ContentType:       *flagMIMEType,
-		VisibilityTimeout: int(*flagVisibilityTimeout),
-		HTTPTimeout:       int(*flagHTTPTimeout),
-		MaxConnections:    int(*flagConnections),
-		Verbose:           *flagVerbose,
+		SQSQueueURL:            *flagSQSQueueURL,
+		HTTPURL:                httpURL,
+		ContentType:            *flagMIMEType,
+		VisibilityTimeout:      int(*flagVisibilityTimeout),
+		HTTPTimeout:            int(*flagHTTPTimeout),
+		ConnectTimeout:         int(*flagConnectTimeout),
+		MaxConnections:         int(*flagConnections),
+		Pollers:                int(*flagPollers),
+		Logger:                 logger,
+		AWS:                    awsConfig,
+		CronFile:               *flagCronFile,
+		LeaderQueueURL:         *flagLeaderQueueURL,
+		MaxRetries:             int(*flagMaxRetries),
+		DeadLetterQueueURL:     *flagDeadLetterQueueURL,
+		ErrorVisibilityTimeout: int(*flagErrorVisibility),
+		ErrorVisibilityBackoff: *flagErrorBackoff,
+		RetentionPeriod:        int(*flagRetentionPeriod),
+		MaxJobDuration:         int(*flagMaxJobDuration),
+		ShutdownTimeout:        int(*flagShutdownTimeout),
+		BackpressureDelay:      int(*flagBackpressureDelay),
+
+		CircuitBreakerThreshold: int(*flagBreakerThreshold),
+		CircuitBreakerTimeout:   int(*flagBreakerTimeout),
+
+		HealthCheckURL:      *flagHealthCheckURL,
+		HealthCheckAddr:     *flagHealthCheckAddr,
+		HealthCheckTimeout:  int(*flagHealthCheckTimeout),
+		HealthCheckInterval: int(*flagHealthCheckIntv),
+	}
+
+	// the status codes were validated with the config
+	sqsDaemon.SuccessCodes, _ = sqsd.ParseStatusCodes(*flagSuccessCodes)
+	sqsDaemon.PermanentFailureCodes, _ = sqsd.ParseStatusCodes(*flagPermanentCodes)
+	sqsDaemon.RetryableCodes, _ = sqsd.ParseStatusCodes(*flagRetryableCodes)
+	sqsDaemon.BackpressureCodes, _ = sqsd.ParseStatusCodes(*flagBackpressureCodes)
+
+	if *flagSourceDir != "" {
+		sqsDaemon.Source = sqsd.NewFileSource(*flagSourceDir, time.Duration(*flagVisibilityTimeout)*time.Second)
+	}
+
+	// servers are the HTTP listeners next to the daemon, they are closed when the daemon stops
+	var servers []*http.Server
+	if *flagLocal {
+		sqsAPI := localsqs.NewServer()
+		sqsAPI.Logger = logger
+
+		queue, err := sqsAPI.CreateQueue("local", map[string]string{"VisibilityTimeout": strconv.Itoa(int(*flagVisibilityTimeout))})
+		if err != nil {
+			fatal(logger, "error creating local queue", err)
+		}
+		sqsDaemon.Source = queue
+		if *flagDeadLetterQueueURL == "" && *flagMaxRetries > 0 {
+			sqsDaemon.DeadLetterQueue, err = sqsAPI.CreateQueue("local-dead-letter", nil)
+			if err != nil {
+				fatal(logger, "error creating local dead-letter queue", err)
+			}
+		}
+
+		servers = append(servers, &http.Server{Addr: *flagLocalAddr, Handler: &sqsd.EnqueueHandler{Queue: queue}})
+		logging.Info(logger, "queue messages by POSTing them to the local queue", logging.F("url", "http://"+*flagLocalAddr+"/"))
+		if *flagLocalSQSAddr != "" {
+			servers = append(servers, &http.Server{Addr: *flagLocalSQSAddr, Handler: sqsAPI})
+			logging.Info(logger, "serving the SQS API", logging.F("url", "http://"+*flagLocalSQSAddr+"/"), logging.F("queue_url", "http://"+*flagLocalSQSAddr+"/000000000000/local"))
+		}
 	}
 
-	err := sqsDaemon.Start()
+	if *flagAdminAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", sqsDaemon.MetricsHandler())
+		mux.Handle("/healthz", sqsDaemon.HealthHandler())
+		mux.Handle("/readyz", sqsDaemon.ReadyHandler())
+		servers = append(servers, &http.Server{Addr: *flagAdminAddr, Handler: mux})
+	}
+
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				fatal(logger, "error serving HTTP", err)
+			}
+		}(srv)
+	}
+
+	// stop gracefully on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logging.Info(logger, "received signal, stopping", logging.F("signal", sig))
+		cancel()
+	}()
+
+	err = sqsDaemon.Run(ctx)
+	for _, srv := range servers {
+		srv.Close()
+	}
+	switch {
+	case err == context.DeadlineExceeded:
+		logging.Warn(logger, "stopped, in-flight deliveries did not finish within the shutdown timeout and were aborted", logging.F("shutdown_timeout", *flagShutdownTimeout))
+		os.Exit(exitDeliveriesAborted)
+	case err != nil:
+		fatal(logger, "error running daemon", err)
+	}
+	logging.Info(logger, "stopped")
+}
+
+// newLogger returns the logger for the log-format and log-level flags, verbose sets level debug.
+// The flags are checked by validateConfig.
+func newLogger(format, level string, verbose bool) logging.Logger {
+	f, _ := logging.ParseFormat(format)
+	l, _ := logging.ParseLevel(level)
+	if verbose {
+		l = logging.LevelDebug
+	}
+	return logging.New(os.Stderr, f, l)
+}
+
+// fatal logs msg with err and exits with code 1
+func fatal(logger logging.Logger, msg string, err error) {
 	if err != nil {
-		log.Fatal(err)
+		logging.Error(logger, msg, logging.Err(err))
+	} else {
+		logging.Error(logger, msg)
 	}
+	os.Exit(1)
+}
 
-	// TODO determine if we need a stop command
-	for {
-		time.Sleep(time.Second)
+// splitList splits a comma separated flag value, an empty value returns an empty list
+func splitList(s string) []string {
+	list := strings.Split(s, ",")
+	if len(list) == 1 && len(list[0]) == 0 {
+		return make([]string, 0)
 	}
+	return list
 }
@@ -0,0 +1,102 @@
+package sqsd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// attributesHeader is the header with all message attributes as JSON object, like
+// {"name": {"DataType": "Binary", "BinaryValue": "<base64>"}}, the format of the SQS JSON API
+const attributesHeader = "X-Aws-Sqsd-Attributes"
+
+// isBinary reports whether the value of the attribute is BinaryValue, also for custom types like Binary.gif
+func (a *MessageAttribute) isBinary() bool {
+	return strings.HasPrefix(a.DataType, "Binary")
+}
+
+// headerValue returns the value of the attribute in its X-Aws-Sqsd-Attr-<name> header, binary values are base64 encoded
+func (a *MessageAttribute) headerValue() string {
+	if a.isBinary() {
+		return base64.StdEncoding.EncodeToString(a.BinaryValue)
+	}
+	return a.StringValue
+}
+
+// setAttributeHeaders adds the message attributes to h, each in an X-Aws-Sqsd-Attr-<name> header and
+// all together with their data types in the X-Aws-Sqsd-Attributes header.
+// An attribute is only in the JSON header when its name is not a valid header name, its value is not a valid
+// header value or its name differs only in case from an attribute that sorts before it.
+func setAttributeHeaders(h http.Header, attrs map[string]*MessageAttribute) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := attrs[name].headerValue()
+		key := http.CanonicalHeaderKey(attrHeaderPrefix + name)
+		if !validHeaderName(name) || !validHeaderValue(value) || h.Get(key) != "" {
+			continue
+		}
+		h.Set(key, value)
+	}
+
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	h.Set(attributesHeader, string(b))
+	return nil
+}
+
+// parseAttributesHeader decodes the X-Aws-Sqsd-Attributes header
+func parseAttributesHeader(value string) (map[string]*MessageAttribute, error) {
+	var attrs map[string]*MessageAttribute
+	if err := json.Unmarshal([]byte(value), &attrs); err != nil {
+		return nil, err
+	}
+	for name, attr := range attrs {
+		if attr == nil {
+			return nil, fmt.Errorf("attribute %s has no value", name)
+		}
+		switch strings.SplitN(attr.DataType, ".", 2)[0] {
+		case "String", "Number", "Binary":
+		default:
+			return nil, fmt.Errorf("attribute %s has invalid data type %q, it must start with String, Number or Binary", name, attr.DataType)
+		}
+	}
+	return attrs, nil
+}
+
+// validHeaderName reports whether s is a token as defined by RFC 7230
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x7f || c <= ' ' || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue reports whether s has no control characters other than tab
+func validHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
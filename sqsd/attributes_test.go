@@ -0,0 +1,110 @@
+package sqsd
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestSetAttributeHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs map[string]*MessageAttribute
+		want  map[string]string // headers without the JSON header, an empty value means the header is not set
+	}{
+		{
+			name: "string and number",
+			attrs: map[string]*MessageAttribute{
+				"customer": {DataType: "String", StringValue: "acme"},
+				"count":    {DataType: "Number", StringValue: "3"},
+			},
+			want: map[string]string{"X-Aws-Sqsd-Attr-Customer": "acme", "X-Aws-Sqsd-Attr-Count": "3"},
+		},
+		{
+			name: "binary is base64 encoded",
+			attrs: map[string]*MessageAttribute{
+				"image": {DataType: "Binary.gif", BinaryValue: []byte{0, 1, 0xff}},
+			},
+			want: map[string]string{"X-Aws-Sqsd-Attr-Image": "AAH/"},
+		},
+		{
+			name: "invalid header name",
+			attrs: map[string]*MessageAttribute{
+				"a b": {DataType: "String", StringValue: "x"},
+			},
+			want: map[string]string{"X-Aws-Sqsd-Attr-A b": ""},
+		},
+		{
+			name: "invalid header value",
+			attrs: map[string]*MessageAttribute{
+				"text": {DataType: "String", StringValue: "line\nbreak"},
+				"tab":  {DataType: "String", StringValue: "a\tb"},
+			},
+			want: map[string]string{"X-Aws-Sqsd-Attr-Text": "", "X-Aws-Sqsd-Attr-Tab": "a\tb"},
+		},
+		{
+			name: "names that differ in case",
+			attrs: map[string]*MessageAttribute{
+				"id": {DataType: "String", StringValue: "lower"},
+				"ID": {DataType: "String", StringValue: "upper"},
+			},
+			want: map[string]string{"X-Aws-Sqsd-Attr-Id": "upper"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := make(http.Header)
+			if err := setAttributeHeaders(h, test.attrs); err != nil {
+				t.Fatal(err)
+			}
+			set := 0
+			for key, want := range test.want {
+				if got := h.Get(key); got != want {
+					t.Errorf("header %s is %q, want %q", key, got, want)
+				}
+				if want != "" {
+					set++
+				}
+			}
+			if len(h) != set+1 {
+				t.Errorf("%d headers are set, want %d and the JSON header: %v", len(h), set, h)
+			}
+
+			// all attributes are in the JSON header
+			attrs, err := parseAttributesHeader(h.Get(attributesHeader))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attrs) != len(test.attrs) {
+				t.Fatalf("%d attributes in the JSON header, want %d", len(attrs), len(test.attrs))
+			}
+			for name, want := range test.attrs {
+				got := attrs[name]
+				if got == nil || got.DataType != want.DataType || got.StringValue != want.StringValue || !bytes.Equal(got.BinaryValue, want.BinaryValue) {
+					t.Errorf("attribute %s is %+v in the JSON header, want %+v", name, got, want)
+				}
+			}
+		})
+	}
+
+	h := make(http.Header)
+	if err := setAttributeHeaders(h, nil); err != nil || len(h) != 0 {
+		t.Errorf("headers %v and error %v without attributes", h, err)
+	}
+}
+
+func TestParseAttributesHeader(t *testing.T) {
+	invalid := []string{
+		``,
+		`[]`,
+		`{"a": null}`,
+		`{"a": {"DataType": "Text", "StringValue": "x"}}`,
+		`{"a": {"DataType": "Binary", "BinaryValue": "not base64"}}`,
+	}
+	for _, value := range invalid {
+		if _, err := parseAttributesHeader(value); err == nil {
+			t.Errorf("expected an error parsing %s", value)
+		}
+	}
+}
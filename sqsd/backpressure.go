@@ -0,0 +1,110 @@
+package sqsd
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// backpressureReason is the reason receiving is paused for while the endpoint is overloaded
+	backpressureReason = "backpressure"
+
+	// defaultBackpressureDelay is the delay in seconds used when BackpressureDelay is 0
+	defaultBackpressureDelay = 10
+)
+
+// backpressure keeps the time receiving is paused until because the endpoint is overloaded
+type backpressure struct {
+	mu    sync.Mutex
+	until time.Time
+	timer *time.Timer
+}
+
+// isBackpressure reports whether a response with the status code means the endpoint is overloaded
+func (c *Client) isBackpressure(code int) bool {
+	return c.BackpressureCodes.Contains(code)
+}
+
+// backpressureDelay returns the time to wait after a backpressure response, the Retry-After of the
+// response or BackpressureDelay, in whole seconds up to the maximum visibility timeout
+func (c *Client) backpressureDelay(retryAfter time.Duration) time.Duration {
+	d := retryAfter
+	if d <= 0 {
+		d = time.Duration(c.BackpressureDelay) * time.Second
+		if d <= 0 {
+			d = defaultBackpressureDelay * time.Second
+		}
+	}
+	if max := maxVisibilityTimeout * time.Second; d > max {
+		d = max
+	}
+	return (d + time.Second - 1).Truncate(time.Second)
+}
+
+// pauseFor pauses receiving messages for d, a later backpressure response extends the pause
+func (c *Client) pauseFor(d time.Duration) {
+	bp := &c.backpressure
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if !until.After(bp.until) {
+		return
+	}
+	if bp.timer != nil {
+		bp.timer.Stop()
+	} else {
+		c.Pause(backpressureReason)
+	}
+	bp.until = until
+	bp.timer = time.AfterFunc(d, func() {
+		bp.mu.Lock()
+		defer bp.mu.Unlock()
+
+		// the pause was extended after this timer was set
+		if !bp.until.Equal(until) {
+			return
+		}
+		bp.until = time.Time{}
+		bp.timer = nil
+		c.Resume(backpressureReason)
+	})
+}
+
+// stopBackpressure stops the timer that resumes receiving after a backpressure response
+func (c *Client) stopBackpressure() {
+	bp := &c.backpressure
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if bp.timer != nil {
+		bp.timer.Stop()
+		bp.timer = nil
+	}
+}
+
+// parseRetryAfter returns the duration of a Retry-After header in seconds or as HTTP date, 0 when it is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		if seconds > maxVisibilityTimeout {
+			seconds = maxVisibilityTimeout
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package sqsd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"  ", 0},
+		{"0", 0},
+		{"120", 120 * time.Second},
+		{" 5 ", 5 * time.Second},
+		{"-1", 0},
+		{"50000", maxVisibilityTimeout * time.Second},
+		{"1.5", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.in); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.in, got, test.want)
+		}
+	}
+
+	// an HTTP date only has seconds
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got <= 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %s, want about a minute", date, got)
+	}
+}
+
+func TestClientBackpressure(t *testing.T) {
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.MaxConnections = 1
+	c.BackpressureCodes, _ = ParseStatusCodes("429")
+
+	send(t, src, "a", "b")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "receiving to be paused", func() bool {
+		paused := c.Paused()
+		return len(paused) == 1 && paused[0] == backpressureReason
+	})
+	waitFor(t, "the messages to be delivered", func() bool { return queueLen(src) == 0 })
+	stopClient(t, c)
+
+	times := e.requestTimes()
+	if len(times) != 3 {
+		t.Fatalf("%d requests, want 3", len(times))
+	}
+	if d := times[1].Sub(times[0]); d < time.Second {
+		t.Errorf("the next request was sent %s after the Retry-After of 1 second", d)
+	}
+	if paused := c.Paused(); len(paused) != 0 {
+		t.Errorf("receiving is still paused for %v", paused)
+	}
+	if m := c.stats(); m.delivered.Get() != 2 || m.rejected.Get() != 0 {
+		t.Errorf("%d messages delivered and %d rejected, want 2 and 0", m.delivered.Get(), m.rejected.Get())
+	}
+}
@@ -0,0 +1,175 @@
+package sqsd
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+const (
+	// breakerOpenReason is the reason receiving is paused for while the circuit breaker is open
+	breakerOpenReason = "circuit breaker open"
+	// breakerProbeReason is the reason receiving is paused for while a probe message is delivered
+	breakerProbeReason = "circuit breaker probe"
+
+	// defaultCircuitBreakerTimeout is the time in seconds the circuit breaker stays open when CircuitBreakerTimeout is 0
+	defaultCircuitBreakerTimeout = 30
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker counts consecutive endpoint failures and pauses receiving while the endpoint is down
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	// probing is set while the probe message of the half-open state is received and delivered
+	probing bool
+	// timer makes the open circuit breaker half-open, opened counts the times it was opened
+	timer  *time.Timer
+	opened int
+}
+
+// recordDelivery updates the circuit breaker with the result of a delivery. Connection errors and 5xx responses
+// are failures of the endpoint, all other responses show it is up. Backpressure responses, aborted deliveries
+// and other errors do not change the circuit breaker.
+func (c *Client) recordDelivery(err error) {
+	if c.CircuitBreakerThreshold <= 0 || c.deliverCtx.Err() != nil {
+		return
+	}
+
+	switch e := err.(type) {
+	case nil:
+		c.breakerSuccess()
+	case *url.Error:
+		c.breakerFailure()
+	case *statusError:
+		if c.isBackpressure(e.StatusCode) {
+			return
+		}
+		if e.StatusCode >= 500 {
+			c.breakerFailure()
+		} else {
+			c.breakerSuccess()
+		}
+	}
+}
+
+func (c *Client) breakerSuccess() {
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != breakerHalfOpen {
+		return
+	}
+	b.state = breakerClosed
+	b.probing = false
+	c.pauser.set(breakerProbeReason, false)
+	logging.Info(c.log(), "circuit breaker closed, the probe message was delivered")
+}
+
+func (c *Client) breakerFailure() {
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+	case b.state == breakerClosed && b.failures >= c.CircuitBreakerThreshold:
+	default:
+		return
+	}
+
+	timeout := time.Duration(c.CircuitBreakerTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultCircuitBreakerTimeout * time.Second
+	}
+
+	b.state = breakerOpen
+	b.probing = false
+	c.pauser.set(breakerOpenReason, true)
+	c.pauser.set(breakerProbeReason, false)
+	logging.Warn(c.log(), "circuit breaker opened, pausing receiving messages",
+		logging.F("failures", b.failures), logging.F(logging.FieldDuration, timeout))
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.opened++
+	opened := b.opened
+	b.timer = time.AfterFunc(timeout, func() { c.breakerHalfOpen(opened) })
+}
+
+// breakerHalfOpen lets the next receive take a single probe message, opened is the opening the timer was set for
+func (c *Client) breakerHalfOpen(opened int) {
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen || b.opened != opened {
+		return
+	}
+	b.timer = nil
+	b.state = breakerHalfOpen
+	c.pauser.set(breakerOpenReason, false)
+	logging.Info(c.log(), "circuit breaker half-open, delivering a probe message")
+}
+
+// stopBreaker stops the timer of an open circuit breaker
+func (c *Client) stopBreaker() {
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+// takeProbe reports whether the caller receives the probe message of the half-open circuit breaker,
+// receiving is then paused for everyone else until endProbe is called or the probe is delivered
+func (c *Client) takeProbe() bool {
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerHalfOpen || b.probing {
+		return false
+	}
+	b.probing = true
+	c.pauser.set(breakerProbeReason, true)
+	return true
+}
+
+// endProbe lets another receive take a probe message when the probe did not decide the state,
+// for example because no message was received or it was not delivered to the endpoint
+func (c *Client) endProbe() {
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.probing {
+		return
+	}
+	b.probing = false
+	c.pauser.set(breakerProbeReason, false)
+}
+
+// breakerIsOpen reports whether messages should not be delivered because the circuit breaker is open
+func (c *Client) breakerIsOpen() bool {
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	return c.breaker.state == breakerOpen
+}
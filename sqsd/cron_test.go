@@ -0,0 +1,118 @@
+package sqsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronExpression(t *testing.T) {
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+		"@every 5m",
+	}
+	for _, expr := range invalid {
+		if _, err := parseCronExpression(expr); err == nil {
+			t.Errorf("expected an error parsing %q", expr)
+		}
+	}
+
+	valid := []string{
+		"* * * * *",
+		"0,15,30,45 0-23/2 1-31 1-12 0-7",
+		"*/5 9-17 * jan-dec mon-fri",
+		"0 0 ? * SUN",
+		"@daily",
+		"@Hourly",
+		" @weekly ",
+	}
+	for _, expr := range valid {
+		if _, err := parseCronExpression(expr); err != nil {
+			t.Errorf("error parsing %q: %s", expr, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-03-15 is a Friday
+	from := time.Date(2024, 3, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, time.Date(2024, 3, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", from, time.Date(2024, 3, 15, 10, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", from, time.Date(2024, 3, 15, 10, 25, 0, 0, time.UTC)},
+		{"0,30 * * * *", from, time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)},
+		{"7 10 * * *", from, time.Date(2024, 3, 16, 10, 7, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", from, time.Date(2024, 3, 15, 13, 0, 0, 0, time.UTC)},
+		{"@hourly", from, time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", from, time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", from, time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", from, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", from, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+
+		// named days and months, 7 is sunday as well
+		{"0 8 * * mon-wed", from, time.Date(2024, 3, 18, 8, 0, 0, 0, time.UTC)},
+		{"0 8 * * 7", from, time.Date(2024, 3, 17, 8, 0, 0, 0, time.UTC)},
+		{"0 0 1 feb *", from, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+
+		// a leap day only exists every 4 years
+		{"0 0 29 2 *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", from, time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 4 *", from, time.Time{}},
+
+		// when both day fields are restricted either one matches
+		{"0 0 20 * fri", from, time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 * fri", from, time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)},
+		// when one of them is a star only the other one applies
+		{"0 0 * * fri", from, time.Date(2024, 3, 22, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * ?", from, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+
+		// year wrap
+		{"0 0 1 1 *", time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		s, err := parseCronExpression(test.expr)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.expr, err)
+			continue
+		}
+		if got := s.next(test.from); !got.Equal(test.want) {
+			t.Errorf("next of %q after %s is %s, want %s", test.expr, test.from, got, test.want)
+		}
+	}
+}
+
+func TestCronNextLocation(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := parseCronExpression("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2024, 3, 1, 12, 0, 0, 0, loc)
+	want := time.Date(2024, 3, 2, 2, 30, 0, 0, loc)
+	if got := s.next(from); !got.Equal(want) || got.Location() != loc {
+		t.Errorf("next is %s, want %s", got, want)
+	}
+}
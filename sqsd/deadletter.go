@@ -0,0 +1,66 @@
+package sqsd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+// moveToDeadLetterQueue sends the message body and attributes to the dead-letter queue and deletes the original.
+// Messages of a FIFO queue keep their group and deduplication id.
+func (c *Client) moveToDeadLetterQueue(msg *Message, reason string) error {
+	dead := &Message{
+		Body:              msg.Body,
+		Attributes:        make(map[string]string),
+		MessageAttributes: msg.MessageAttributes,
+	}
+	for _, attr := range []string{AttributeMessageGroupID, AttributeMessageDeduplicationID} {
+		if v := msg.Attributes[attr]; v != "" {
+			dead.Attributes[attr] = v
+		}
+	}
+
+	err := c.DeadLetterQueue.Send(context.Background(), dead, 0)
+	if err != nil {
+		return fmt.Errorf("error sending message to dead-letter queue: %s", err)
+	}
+
+	if err := c.ack(msg); err != nil {
+		return fmt.Errorf("message sent to dead-letter queue, but not deleted: %s", err)
+	}
+
+	logging.Warn(c.messageLog(msg), "message moved to dead-letter queue", logging.F("reason", reason))
+	return nil
+}
+
+// expired reports whether the message is older than RetentionPeriod
+func (c *Client) expired(msg *Message) bool {
+	sent := msg.SentAt()
+	return c.RetentionPeriod > 0 && !sent.IsZero() && time.Since(sent) > time.Duration(c.RetentionPeriod)*time.Second
+}
+
+// discardExpired moves a message older than RetentionPeriod to the dead-letter queue or deletes it
+func (c *Client) discardExpired(msg *Message) bool {
+	return c.discard(msg, fmt.Sprintf("exceeded retention period (sent at %s)", msg.SentAt().Format(time.RFC3339)))
+}
+
+// discard moves a message that will not be delivered to the dead-letter queue when there is one and deletes it otherwise,
+// it returns false when the message could not be moved and is still in the queue
+func (c *Client) discard(msg *Message, reason string) bool {
+	if c.DeadLetterQueue != nil {
+		if err := c.moveToDeadLetterQueue(msg, reason); err != nil {
+			logging.Error(c.messageLog(msg), "error moving message to dead-letter queue", logging.Err(err), logging.F("reason", reason))
+			return false
+		}
+		return true
+	}
+
+	if err := c.ack(msg); err != nil {
+		logging.Error(c.messageLog(msg), "error deleting message", logging.Err(err), logging.F("reason", reason))
+		return false
+	}
+	logging.Warn(c.messageLog(msg), "message deleted", logging.F("reason", reason))
+	return true
+}
@@ -0,0 +1,97 @@
+package sqsd
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExpired(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention int
+		age       time.Duration
+		noSent    bool
+		want      bool
+	}{
+		{name: "older than retention period", retention: 60, age: 2 * time.Minute, want: true},
+		{name: "within retention period", retention: 60, age: 10 * time.Second},
+		{name: "without SentTimestamp", retention: 60, noSent: true},
+		{name: "retention period 0", age: 30 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{RetentionPeriod: test.retention}
+			msg := &Message{Attributes: map[string]string{}}
+			if !test.noSent {
+				msg.Attributes[AttributeSentTimestamp] = timestampMillis(time.Now().Add(-test.age))
+			}
+			if got := c.expired(msg); got != test.want {
+				t.Errorf("got expired %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+// unsentSource is a Source whose messages have no SentTimestamp, like a directory source
+type unsentSource struct {
+	*MemorySource
+}
+
+func (s unsentSource) Receive(ctx context.Context, max int) ([]*Message, error) {
+	msgs, err := s.MemorySource.Receive(ctx, max)
+	for _, msg := range msgs {
+		delete(msg.Attributes, AttributeSentTimestamp)
+	}
+	return msgs, err
+}
+
+func TestClientRetentionPeriod(t *testing.T) {
+	tests := []struct {
+		name          string
+		retention     int
+		noSent        bool
+		deadLetter    bool
+		wantDelivered bool
+	}{
+		{name: "expired message is deleted", retention: 1},
+		{name: "expired message is moved", retention: 1, deadLetter: true},
+		{name: "message without SentTimestamp is delivered", retention: 1, noSent: true, wantDelivered: true},
+		{name: "retention period 0 delivers", wantDelivered: true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			e := newTestEndpoint(respondWith(http.StatusOK))
+			defer e.Close()
+			c, src := newTestClient(e)
+			c.RetentionPeriod = test.retention
+			if test.noSent {
+				c.Source = unsentSource{src}
+			}
+			dlq := NewMemorySource("dlq", 30*time.Second)
+			if test.deadLetter {
+				c.DeadLetterQueue = dlq
+			}
+
+			send(t, src, "old")
+			time.Sleep(1100 * time.Millisecond)
+			if err := c.Start(); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the message to be handled", func() bool { return queueLen(src) == 0 })
+			stopClient(t, c)
+
+			if delivered := e.count() == 1; delivered != test.wantDelivered {
+				t.Errorf("delivered %t, want %t", delivered, test.wantDelivered)
+			}
+			if moved := queueLen(dlq) == 1; moved != test.deadLetter {
+				t.Errorf("moved to the dead-letter queue %t, want %t", moved, test.deadLetter)
+			}
+		})
+	}
+}
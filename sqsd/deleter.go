@@ -0,0 +1,193 @@
+package sqsd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// deleteBatchInterval is the maximum time a delete waits for the batch to fill up
+	deleteBatchInterval = 500 * time.Millisecond
+	// maxDeleteAttempts is the number of times deleting a message is tried
+	maxDeleteAttempts = 3
+	// deleteRetryBackoff is the time before a failed delete is retried, it doubles for every attempt
+	deleteRetryBackoff = 500 * time.Millisecond
+)
+
+// deleter collects delivered messages and deletes them using DeleteMessageBatch,
+// a batch is sent when it is full or deleteBatchInterval has passed
+type deleter struct {
+	s       *SQSSource
+	entries chan *deleteEntry
+	quit    chan struct{}
+	done    chan struct{}
+
+	// mu is held for reading while queueing entries, so stop cannot close quit while an entry is queued
+	mu      sync.RWMutex
+	stopped bool
+}
+
+type deleteEntry struct {
+	msg      *Message
+	attempts int
+	// retryAt is the time a failed delete is retried
+	retryAt time.Time
+}
+
+func newDeleter(s *SQSSource) *deleter {
+	d := &deleter{
+		s:       s,
+		entries: make(chan *deleteEntry, maxReceiveMessages),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// delete queues the message for deletion, it returns an error when the deleter is stopped
+func (d *deleter) delete(msg *Message) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stopped {
+		return fmt.Errorf("message not deleted, the queue is closed")
+	}
+	d.entries <- &deleteEntry{msg: msg}
+	return nil
+}
+
+// stop flushes all queued deletes, it returns an error if not all deletes were sent before ctx is done.
+// It can be called more than once.
+func (d *deleter) stop(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.quit)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timeout deleting delivered messages, they will be received again after their visibility timeout")
+	}
+}
+
+func (d *deleter) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(deleteBatchInterval)
+	defer ticker.Stop()
+
+	var pending []*deleteEntry
+	for {
+		select {
+		case e := <-d.entries:
+			pending = d.flush(append(pending, e), false)
+		case <-d.quit:
+			for {
+				select {
+				case e := <-d.entries:
+					pending = append(pending, e)
+					continue
+				default:
+				}
+				pending = d.flush(pending, true)
+				if len(pending) == 0 {
+					return
+				}
+				// wait for the backoff of the failed deletes
+				time.Sleep(deleteRetryBackoff)
+			}
+		case <-ticker.C:
+			pending = d.flush(pending, true)
+		}
+	}
+}
+
+// flush deletes the pending entries that are due in batches of at most maxReceiveMessages and returns the entries
+// that still have to be deleted. Without all only full batches are sent, the rest waits for the next flush.
+func (d *deleter) flush(pending []*deleteEntry, all bool) []*deleteEntry {
+	now := time.Now()
+	var due, waiting []*deleteEntry
+	for _, e := range pending {
+		if e.retryAt.After(now) {
+			waiting = append(waiting, e)
+		} else {
+			due = append(due, e)
+		}
+	}
+
+	for len(due) >= maxReceiveMessages || (all && len(due) > 0) {
+		n := len(due)
+		if n > maxReceiveMessages {
+			n = maxReceiveMessages
+		}
+		waiting = append(waiting, d.deleteBatch(due[:n])...)
+		due = due[n:]
+	}
+	return append(waiting, due...)
+}
+
+// deleteBatch deletes at most maxReceiveMessages entries and returns the entries that should be retried
+func (d *deleter) deleteBatch(batch []*deleteEntry) []*deleteEntry {
+	input := &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(d.s.QueueURL),
+		Entries:  make([]*sqs.DeleteMessageBatchRequestEntry, len(batch)),
+	}
+	for i, e := range batch {
+		e.attempts++
+		input.Entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(e.msg.ReceiptHandle),
+		}
+	}
+
+	var retry []*deleteEntry
+
+	out, err := d.s.sqsClient.DeleteMessageBatch(input)
+	if err != nil {
+		logging.Error(logOrDefault(d.s.Logger), "error deleting messages from queue",
+			logging.F(logging.FieldQueue, d.s.QueueName()), logging.F("count", len(batch)), logging.Err(err))
+		for _, e := range batch {
+			retry = d.retry(retry, e, err.Error())
+		}
+		return retry
+	}
+
+	for _, ok := range out.Successful {
+		i, _ := strconv.Atoi(aws.StringValue(ok.Id))
+		logging.Debug(d.s.messageLog(batch[i].msg), "message deleted from queue")
+		if d.s.deleted != nil {
+			d.s.deleted(batch[i].msg)
+		}
+	}
+	for _, failed := range out.Failed {
+		i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+		reason := aws.StringValue(failed.Code) + ": " + aws.StringValue(failed.Message)
+		if aws.BoolValue(failed.SenderFault) {
+			// retrying will not help, for example because the receipt handle expired
+			logging.Error(d.s.messageLog(batch[i].msg), "error deleting message from queue", logging.F(logging.FieldError, reason))
+			continue
+		}
+		retry = d.retry(retry, batch[i], reason)
+	}
+	return retry
+}
+
+func (d *deleter) retry(retry []*deleteEntry, e *deleteEntry, reason string) []*deleteEntry {
+	if e.attempts >= maxDeleteAttempts {
+		logging.Error(d.s.messageLog(e.msg), "error deleting message from queue", logging.F("attempts", e.attempts), logging.F(logging.FieldError, reason))
+		return retry
+	}
+	e.retryAt = time.Now().Add(deleteRetryBackoff << uint(e.attempts-1))
+	return append(retry, e)
+}
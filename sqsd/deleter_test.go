@@ -0,0 +1,155 @@
+package sqsd
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeDeleteSQS records DeleteMessageBatch calls, the first failBatches calls fail
+type fakeDeleteSQS struct {
+	sqsiface.SQSAPI
+
+	mu          sync.Mutex
+	failBatches int
+	calls       int
+	maxEntries  int
+	deleted     map[string]int
+}
+
+func (f *fakeDeleteSQS) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if len(input.Entries) > f.maxEntries {
+		f.maxEntries = len(input.Entries)
+	}
+	if len(input.Entries) > maxReceiveMessages {
+		return nil, errors.New("AWS.SimpleQueueService.TooManyEntriesInBatchRequest")
+	}
+	if f.calls <= f.failBatches {
+		return nil, errors.New("service unavailable")
+	}
+
+	out := new(sqs.DeleteMessageBatchOutput)
+	for _, e := range input.Entries {
+		f.deleted[aws.StringValue(e.ReceiptHandle)]++
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+func (f *fakeDeleteSQS) result() (calls, maxEntries, deleted int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls, f.maxEntries, len(f.deleted)
+}
+
+func TestDeleterRetriesInBatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		failBatches int
+		messages    int
+		wantDeleted int
+	}{
+		{name: "no failures", messages: 25, wantDeleted: 25},
+		{name: "failed batch is retried", failBatches: 1, messages: 25, wantDeleted: 25},
+		{name: "failing batches are retried", failBatches: 3, messages: 40, wantDeleted: 40},
+		{name: "deletes are given up", failBatches: 1000, messages: 12, wantDeleted: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeDeleteSQS{failBatches: test.failBatches, deleted: make(map[string]int)}
+			src := NewSQSSource(fake, "https://sqs.eu-west-1.amazonaws.com/123456789012/test", 30)
+			src.Logger = logging.Discard
+			var notified counter
+			src.notifyDeleted(func(*Message) {
+				notified.Add(1)
+			})
+
+			for i := 0; i < test.messages; i++ {
+				src.Ack(context.Background(), &Message{ID: strconv.Itoa(i), ReceiptHandle: "rh-" + strconv.Itoa(i)})
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := src.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			calls, maxEntries, deleted := fake.result()
+			if maxEntries > maxReceiveMessages {
+				t.Errorf("a batch of %d entries was sent", maxEntries)
+			}
+			if deleted != test.wantDeleted {
+				t.Errorf("%d messages deleted in %d calls, want %d", deleted, calls, test.wantDeleted)
+			}
+			if n := notified.Get(); n != deleted {
+				t.Errorf("%d deletes notified, %d messages deleted", n, deleted)
+			}
+		})
+	}
+}
+
+func TestDeleterCloseTwice(t *testing.T) {
+	fake := &fakeDeleteSQS{deleted: make(map[string]int)}
+	src := NewSQSSource(fake, "https://sqs.eu-west-1.amazonaws.com/123456789012/test", 30)
+	src.Logger = logging.Discard
+	src.Ack(context.Background(), &Message{ID: "1", ReceiptHandle: "rh-1"})
+
+	for i := 0; i < 2; i++ {
+		if err := src.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, deleted := fake.result(); deleted != 1 {
+		t.Errorf("%d messages deleted, want 1", deleted)
+	}
+}
+
+func TestAckConcurrentWithClose(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		fake := &fakeDeleteSQS{deleted: make(map[string]int)}
+		src := NewSQSSource(fake, "https://sqs.eu-west-1.amazonaws.com/123456789012/test", 30)
+		src.Logger = logging.Discard
+
+		var (
+			wg    sync.WaitGroup
+			acked counter
+		)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := src.Ack(context.Background(), &Message{ID: strconv.Itoa(i), ReceiptHandle: "rh-" + strconv.Itoa(i)}); err == nil {
+					acked.Add(1)
+				}
+			}(i)
+		}
+		if err := src.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		// every acknowledged message is deleted, the others returned an error
+		if _, _, deleted := fake.result(); deleted != acked.Get() {
+			t.Fatalf("%d messages deleted, %d acknowledged", deleted, acked.Get())
+		}
+	}
+
+	src := NewSQSSource(&fakeDeleteSQS{deleted: make(map[string]int)}, "https://sqs.eu-west-1.amazonaws.com/123456789012/test", 30)
+	src.Close(context.Background())
+	if err := src.Ack(context.Background(), &Message{ID: "1", ReceiptHandle: "rh-1"}); err == nil {
+		t.Error("expected an error acknowledging a message after Close")
+	}
+}
@@ -0,0 +1,90 @@
+package sqsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// attrHeaderPrefix is the prefix of the headers message attributes are sent in
+	attrHeaderPrefix = "X-Aws-Sqsd-Attr-"
+
+	// maxEnqueueDelay is the maximum delay of a message in seconds, the same as SQS (15 minutes)
+	maxEnqueueDelay = 900
+
+	// maxEnqueueBodySize is the maximum message size, the same as SQS (256 KiB)
+	maxEnqueueBodySize = 256 * 1024
+)
+
+// EnqueueHandler is an HTTP API to send messages to a queue, used for development without AWS.
+// A POST request queues its body as message, X-Aws-Sqsd-Attr-<name> headers are added as String message attributes
+// and the delay query parameter sets the delay in seconds. Attributes of other types are set in the X-Aws-Sqsd-Attributes
+// header, a JSON object in the same format the daemon delivers them in. The response is a JSON object with the message id.
+// Header names are canonicalized, so X-Aws-Sqsd-Attr-customer-id adds the attribute Customer-Id,
+// attributes in X-Aws-Sqsd-Attributes keep their exact names.
+type EnqueueHandler struct {
+	Queue Sender
+}
+
+type enqueueResponse struct {
+	MessageID string `json:"MessageId"`
+}
+
+func (h *EnqueueHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEnqueueBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading body: %s", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var delay int
+	if d := r.URL.Query().Get("delay"); d != "" {
+		delay, err = strconv.Atoi(d)
+		if err != nil || delay < 0 || delay > maxEnqueueDelay {
+			http.Error(w, fmt.Sprintf("delay must be between 0 and %d seconds", maxEnqueueDelay), http.StatusBadRequest)
+			return
+		}
+	}
+
+	msg := &Message{Body: string(body)}
+	if v := r.Header.Get(attributesHeader); v != "" {
+		msg.MessageAttributes, err = parseAttributesHeader(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s header: %s", attributesHeader, err), http.StatusBadRequest)
+			return
+		}
+	}
+	// attributes in the JSON header keep their type, the header with the same name is ignored
+	typed := make(map[string]bool, len(msg.MessageAttributes))
+	for name := range msg.MessageAttributes {
+		typed[http.CanonicalHeaderKey(attrHeaderPrefix+name)] = true
+	}
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, attrHeaderPrefix) || len(name) == len(attrHeaderPrefix) || typed[name] {
+			continue
+		}
+		if msg.MessageAttributes == nil {
+			msg.MessageAttributes = make(map[string]*MessageAttribute)
+		}
+		msg.MessageAttributes[name[len(attrHeaderPrefix):]] = stringAttribute(values[0])
+	}
+
+	if err := h.Queue.Send(r.Context(), msg, time.Duration(delay)*time.Second); err != nil {
+		http.Error(w, fmt.Sprintf("error queueing message: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&enqueueResponse{MessageID: msg.ID})
+}
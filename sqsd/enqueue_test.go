@@ -0,0 +1,124 @@
+package sqsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingSender fails every Send
+type failingSender struct{}
+
+func (failingSender) Send(context.Context, *Message, time.Duration) error {
+	return errors.New("queue unavailable")
+}
+
+func TestEnqueueHandler(t *testing.T) {
+	src := NewMemorySource("test", 30*time.Second)
+	srv := httptest.NewServer(&EnqueueHandler{Queue: src})
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/?delay=0", strings.NewReader(`{"job":"report"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Aws-Sqsd-Attr-customer-id", "42")
+	req.Header.Set("X-Aws-Sqsd-Attr-Image", "ignored")
+	req.Header.Set(attributesHeader, `{"Image":{"DataType":"Binary","BinaryValue":"AAE="},"exact_Name":{"DataType":"Number","StringValue":"1"}}`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s, want 200 OK", resp.Status)
+	}
+	var out enqueueResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := src.Receive(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.ID != out.MessageID || msg.Body != `{"job":"report"}` {
+		t.Errorf("queued message %s with body %q, want message %s", msg.ID, msg.Body, out.MessageID)
+	}
+	want := map[string]*MessageAttribute{
+		"Customer-Id": {DataType: "String", StringValue: "42"},
+		"Image":       {DataType: "Binary", BinaryValue: []byte{0, 1}},
+		"exact_Name":  {DataType: "Number", StringValue: "1"},
+	}
+	if !reflect.DeepEqual(msg.MessageAttributes, want) {
+		t.Errorf("got attributes %v, want %v", msg.MessageAttributes, want)
+	}
+}
+
+func TestEnqueueHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		header  map[string]string
+		queue   Sender
+		status  int
+		allowed string
+	}{
+		{name: "wrong method", method: http.MethodGet, status: http.StatusMethodNotAllowed, allowed: http.MethodPost},
+		{name: "body too large", body: strings.Repeat("x", maxEnqueueBodySize+1), status: http.StatusRequestEntityTooLarge},
+		{name: "invalid delay", url: "/?delay=901", status: http.StatusBadRequest},
+		{name: "invalid attributes", header: map[string]string{attributesHeader: "{"}, status: http.StatusBadRequest},
+		{name: "queue error", queue: failingSender{}, status: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := NewMemorySource("test", 30*time.Second)
+			var queue Sender = src
+			if test.queue != nil {
+				queue = test.queue
+			}
+			srv := httptest.NewServer(&EnqueueHandler{Queue: queue})
+			defer srv.Close()
+
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req, err := http.NewRequest(method, srv.URL+test.url, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Errorf("got status %s, want %d", resp.Status, test.status)
+			}
+			if allow := resp.Header.Get("Allow"); allow != test.allowed {
+				t.Errorf("got Allow header %q, want %q", allow, test.allowed)
+			}
+			if n := queueLen(src); n != 0 {
+				t.Errorf("%d messages queued", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package sqsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+const (
+	// gateReason is the reason receiving is paused for while the health check of the endpoint fails
+	gateReason = "endpoint unhealthy"
+
+	// gateStartInterval is the time between health checks while waiting for the endpoint at start
+	gateStartInterval = time.Second
+
+	// gateCheckTimeout is the timeout of a single health check
+	gateCheckTimeout = 5 * time.Second
+)
+
+// gateEnabled reports whether receiving waits for a health check of the endpoint
+func (c *Client) gateEnabled() bool {
+	return c.HealthCheckURL != "" || c.HealthCheckAddr != ""
+}
+
+// gate waits until the health check succeeds and then resumes receiving, receiving is paused by Start.
+// With HealthCheckInterval it keeps checking and pauses receiving while the check fails.
+func (c *Client) gate() {
+	started := time.Now()
+	timeout := time.Duration(c.HealthCheckTimeout) * time.Second
+	for {
+		err := c.checkHealth(c.ctx)
+		if err == nil {
+			break
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+		if timeout > 0 && time.Since(started) >= timeout {
+			c.gateErr <- fmt.Errorf("endpoint not healthy within %s: %s", timeout, err)
+			return
+		}
+		logging.Debug(c.log(), "waiting for endpoint to become healthy", logging.Err(err))
+		if !sleepContext(c.ctx, gateStartInterval) {
+			return
+		}
+	}
+	logging.Info(c.log(), "endpoint is healthy, receiving messages", logging.F(logging.FieldDuration, time.Since(started)))
+	c.pauser.set(gateReason, false)
+
+	if c.HealthCheckInterval <= 0 {
+		return
+	}
+
+	healthy := true
+	for sleepContext(c.ctx, time.Duration(c.HealthCheckInterval)*time.Second) {
+		err := c.checkHealth(c.ctx)
+		if c.ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil && healthy:
+			logging.Warn(c.log(), "endpoint unhealthy, pausing receiving messages", logging.Err(err))
+		case err == nil && !healthy:
+			logging.Info(c.log(), "endpoint healthy again, resuming receiving messages")
+		default:
+			continue
+		}
+		healthy = err == nil
+		c.pauser.set(gateReason, !healthy)
+	}
+}
+
+// checkHealth requests HealthCheckURL, which must respond with a 2xx status code, or connects to HealthCheckAddr
+func (c *Client) checkHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, gateCheckTimeout)
+	defer cancel()
+
+	if c.HealthCheckURL == "" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", c.HealthCheckAddr)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.HealthCheckURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package sqsd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHealthEndpoint returns an endpoint for HealthCheckURL that is healthy from the n-th check on,
+// it is never healthy when n is 0
+func newHealthEndpoint(n int) *testEndpoint {
+	return newTestEndpoint(func(i int, w http.ResponseWriter, r *http.Request) {
+		if n == 0 || i < n {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func TestGateOpensWhenHealthy(t *testing.T) {
+	health := newHealthEndpoint(3)
+	defer health.Close()
+	e := newTestEndpoint(respondWith(http.StatusOK))
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.HealthCheckURL = health.URL
+
+	send(t, src, "a")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopClient(t, c)
+
+	waitFor(t, "the message to be delivered", func() bool { return queueLen(src) == 0 })
+	if n := health.count(); n != 3 {
+		t.Errorf("%d health checks, want 3", n)
+	}
+	if healthy, delivered := health.requestTimes()[2], e.requestTimes()[0]; delivered.Before(healthy) {
+		t.Errorf("message delivered at %s, before the endpoint was healthy at %s", delivered, healthy)
+	}
+}
+
+func TestGateTimeout(t *testing.T) {
+	health := newHealthEndpoint(0)
+	defer health.Close()
+	e := newTestEndpoint(respondWith(http.StatusOK))
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.HealthCheckURL = health.URL
+	c.HealthCheckTimeout = 1
+
+	send(t, src, "a")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopClient(t, c)
+
+	select {
+	case err := <-c.Failed():
+		if err == nil || !strings.Contains(err.Error(), "endpoint not healthy within 1s") {
+			t.Errorf("got error %v, want a health check timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the health check did not time out")
+	}
+	if n := e.count(); n != 0 {
+		t.Errorf("%d deliveries while the endpoint was unhealthy", n)
+	}
+}
+
+func TestRunReturnsGateTimeout(t *testing.T) {
+	health := newHealthEndpoint(0)
+	defer health.Close()
+	e := newTestEndpoint(respondWith(http.StatusOK))
+	defer e.Close()
+	c, _ := newTestClient(e)
+	c.HealthCheckURL = health.URL
+	c.HealthCheckTimeout = 1
+
+	done := make(chan error)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "endpoint not healthy") {
+			t.Errorf("Run returned %v, want a health check timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the health check timed out")
+	}
+}
+
+func TestGateCancelledByStop(t *testing.T) {
+	health := newHealthEndpoint(0)
+	defer health.Close()
+	e := newTestEndpoint(respondWith(http.StatusOK))
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.HealthCheckURL = health.URL
+
+	send(t, src, "a")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a health check", func() bool { return health.count() > 0 })
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- c.Stop(context.Background())
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not end the health checks")
+	}
+
+	select {
+	case err := <-c.Failed():
+		t.Errorf("the daemon failed with %v after Stop", err)
+	default:
+	}
+	if n := e.count(); n != 0 {
+		t.Errorf("%d deliveries while the endpoint was unhealthy", n)
+	}
+	checks := health.count()
+	time.Sleep(1500 * time.Millisecond)
+	if n := health.count(); n != checks {
+		t.Errorf("%d health checks after Stop", n-checks)
+	}
+}
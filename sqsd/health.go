@@ -0,0 +1,191 @@
+package sqsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// receiveStaleAfter is the time without a successful receive after which the daemon is unhealthy
+	receiveStaleAfter = 2 * time.Minute
+
+	// endpointDialTimeout is the timeout of the readiness check connecting to HTTPURL
+	endpointDialTimeout = 2 * time.Second
+)
+
+// health tracks the state of the daemon for the health and readiness checks
+type health struct {
+	mu               sync.Mutex
+	started          bool
+	draining         bool
+	pollers          int
+	lastReceive      time.Time
+	lastReceiveError string
+	// waiting is the number of pollers waiting for a free delivery slot, slotsFreed is when the last one got one
+	waiting    int
+	slotsFreed time.Time
+}
+
+func (h *health) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = true
+	h.lastReceive = time.Now()
+}
+
+func (h *health) drain() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+}
+
+func (h *health) addPoller(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pollers += n
+}
+
+// waitForSlots adds n pollers waiting for a delivery slot, no messages are received while all slots are busy
+func (h *health) waitForSlots(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.waiting += n
+	if n < 0 {
+		h.slotsFreed = time.Now()
+	}
+}
+
+func (h *health) received(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastReceiveError = err.Error()
+		return
+	}
+	h.lastReceive = time.Now()
+	h.lastReceiveError = ""
+}
+
+type healthStatus struct {
+	Status           string    `json:"status"`
+	Pollers          int       `json:"pollers"`
+	WaitingForSlots  int       `json:"waiting_for_slots,omitempty"`
+	LastReceive      time.Time `json:"last_receive"`
+	LastReceiveError string    `json:"last_receive_error,omitempty"`
+	Paused           []string  `json:"paused,omitempty"`
+	Draining         bool      `json:"draining,omitempty"`
+}
+
+type readyStatus struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// HealthHandler returns a liveness check, it responds with 503 Service Unavailable when the daemon is not started,
+// no poller is running or no messages could be received for 2 minutes while receiving is not paused and
+// not all delivery slots are busy
+func (c *Client) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.health.mu.Lock()
+		status := &healthStatus{
+			Status:           "ok",
+			Pollers:          c.health.pollers,
+			WaitingForSlots:  c.health.waiting,
+			LastReceive:      c.health.lastReceive,
+			LastReceiveError: c.health.lastReceiveError,
+			Draining:         c.health.draining,
+		}
+		started := c.health.started
+		// the time a poller waited for a free slot does not count as time without receiving
+		receiving := status.LastReceive
+		if c.health.slotsFreed.After(receiving) {
+			receiving = c.health.slotsFreed
+		}
+		c.health.mu.Unlock()
+		status.Paused = c.Paused()
+
+		switch {
+		case !started:
+			status.Status = "starting"
+		case status.Draining:
+			status.Status = "draining"
+		case status.Pollers == 0:
+			status.Status = "no pollers running"
+		case len(status.Paused) == 0 && status.WaitingForSlots == 0 && time.Since(receiving) > receiveStaleAfter:
+			status.Status = "no messages received since " + status.LastReceive.Format(time.RFC3339)
+		}
+
+		code := http.StatusOK
+		if status.Status != "ok" && status.Status != "draining" {
+			code = http.StatusServiceUnavailable
+		}
+		writeStatus(w, code, status)
+	})
+}
+
+// ReadyHandler returns a readiness check, it responds with 503 Service Unavailable when the daemon is
+// not started, paused or draining, or when HTTPURL is not reachable
+func (c *Client) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := &readyStatus{Status: "ready"}
+
+		c.health.mu.Lock()
+		started, draining := c.health.started, c.health.draining
+		c.health.mu.Unlock()
+
+		if !started {
+			status.Reasons = append(status.Reasons, "starting")
+		}
+		if draining {
+			status.Reasons = append(status.Reasons, "draining")
+		}
+		for _, reason := range c.Paused() {
+			status.Reasons = append(status.Reasons, "paused: "+reason)
+		}
+		if err := c.checkEndpoint(); err != nil {
+			status.Reasons = append(status.Reasons, err.Error())
+		}
+
+		code := http.StatusOK
+		if len(status.Reasons) > 0 {
+			status.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+		writeStatus(w, code, status)
+	})
+}
+
+// checkEndpoint connects to the host of HTTPURL
+func (c *Client) checkEndpoint() error {
+	u, err := url.Parse(c.HTTPURL)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP URL: %s", err)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, endpointDialTimeout)
+	if err != nil {
+		return fmt.Errorf("HTTP endpoint not reachable: %s", err)
+	}
+	conn.Close()
+	return nil
+}
+
+func writeStatus(w http.ResponseWriter, code int, status interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
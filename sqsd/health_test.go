@@ -0,0 +1,47 @@
+package sqsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	stale := time.Now().Add(-receiveStaleAfter - time.Minute)
+
+	tests := []struct {
+		name       string
+		started    bool
+		pollers    int
+		waiting    int
+		received   time.Time
+		slotsFreed time.Time
+		want       int
+	}{
+		{name: "starting", want: http.StatusServiceUnavailable},
+		{name: "receiving", started: true, pollers: 1, received: time.Now(), want: http.StatusOK},
+		{name: "no pollers", started: true, received: time.Now(), want: http.StatusServiceUnavailable},
+		{name: "not receiving", started: true, pollers: 1, received: stale, want: http.StatusServiceUnavailable},
+		{name: "all slots busy", started: true, pollers: 1, waiting: 1, received: stale, want: http.StatusOK},
+		{name: "slot just freed", started: true, pollers: 1, received: stale, slotsFreed: time.Now(), want: http.StatusOK},
+		{name: "slot freed long ago", started: true, pollers: 1, received: stale, slotsFreed: stale, want: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := new(Client)
+			c.health.started = test.started
+			c.health.pollers = test.pollers
+			c.health.waiting = test.waiting
+			c.health.lastReceive = test.received
+			c.health.slotsFreed = test.slotsFreed
+
+			w := httptest.NewRecorder()
+			c.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+			if w.Code != test.want {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, test.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,23 @@
 package sqsd
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+// defaultLogger is used by the queues and leader electors without a Logger
+var defaultLogger = logging.Default(false)
+
+// logOrDefault returns l, or the default logger when l is nil
+func logOrDefault(l logging.Logger) logging.Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
 
 type counter struct {
 	value int
@@ -19,3 +36,15 @@ func (c *counter) Add(n int) int {
 	c.value += n
 	return c.value
 }
+
+// sleepContext sleeps for d and returns false if ctx was done before that
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,270 @@
+package sqsd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// LeaderElector decides which daemon queues the periodic tasks when several daemons share a queue
+type LeaderElector interface {
+	// Campaign acquires and keeps leadership whenever possible until ctx is done, leadership is released on return
+	Campaign(ctx context.Context)
+	// IsLeader reports whether this instance currently holds leadership
+	IsLeader() bool
+}
+
+const (
+	leaderLockBody   = "aws-sqsd leader lock"
+	leaderLockID     = "leader"
+	defaultLeaderTTL = 30 * time.Second
+)
+
+// SQSLeaderElector uses a single message in a dedicated SQS FIFO queue as lock.
+// The daemon that received the message is the leader and keeps it invisible by extending its visibility timeout.
+// When the leader dies the message becomes visible again after TTL and another daemon takes over.
+// A FIFO queue is required: lock messages sent by several daemons at once are deduplicated and only one
+// message of the lock group can be received at a time, the approximate message counts of SQS are not exact enough.
+type SQSLeaderElector struct {
+	QueueURL string
+	TTL      time.Duration
+	// Logger receives the log entries of the elector, when it is nil they are written as text to stderr
+	Logger logging.Logger
+
+	sqsClient sqsiface.SQSAPI
+
+	mu            sync.Mutex
+	receiptHandle string
+	leaseUntil    time.Time
+}
+
+// NewSQSLeaderElector returns a LeaderElector using the SQS queue with queueURL as lock
+func NewSQSLeaderElector(sqsClient sqsiface.SQSAPI, queueURL string, ttl time.Duration) *SQSLeaderElector {
+	return &SQSLeaderElector{
+		QueueURL:  queueURL,
+		TTL:       ttl,
+		sqsClient: sqsClient,
+	}
+}
+
+// ValidateLeaderQueueURL returns an error when queueURL is not the URL of a FIFO queue
+func ValidateLeaderQueueURL(queueURL string) error {
+	if !strings.HasSuffix(queueURL, ".fifo") {
+		return fmt.Errorf("the leader queue must be a FIFO queue, its name must end with .fifo")
+	}
+	return nil
+}
+
+// IsLeader reports whether this daemon holds the lock message and its lease is not expired
+func (e *SQSLeaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.receiptHandle != "" && time.Now().Before(e.leaseUntil)
+}
+
+// Campaign implements LeaderElector, it never acquires leadership when QueueURL is not a FIFO queue
+func (e *SQSLeaderElector) Campaign(ctx context.Context) {
+	if err := ValidateLeaderQueueURL(e.QueueURL); err != nil {
+		logging.Error(logOrDefault(e.Logger), "not campaigning for leadership", logging.Err(err))
+		return
+	}
+	defer e.release()
+
+	for ctx.Err() == nil {
+		if e.IsLeader() {
+			if !sleepContext(ctx, e.TTL/3) {
+				return
+			}
+			e.renew(ctx)
+			continue
+		}
+		e.acquire(ctx)
+	}
+}
+
+func (e *SQSLeaderElector) acquire(ctx context.Context) {
+	start := time.Now()
+	out, err := e.sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(e.QueueURL),
+		VisibilityTimeout:   aws.Int64(int64(e.TTL / time.Second)),
+		MaxNumberOfMessages: aws.Int64(1),
+		WaitTimeSeconds:     aws.Int64(20),
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			logging.Error(logOrDefault(e.Logger), "error receiving leader lock", logging.F(logging.FieldQueue, e.QueueURL), logging.Err(err))
+			sleepContext(ctx, 2*time.Second)
+		}
+		return
+	}
+
+	if len(out.Messages) == 0 {
+		e.createLock(ctx)
+		return
+	}
+
+	e.mu.Lock()
+	e.receiptHandle = aws.StringValue(out.Messages[0].ReceiptHandle)
+	e.leaseUntil = start.Add(e.TTL)
+	e.mu.Unlock()
+	logging.Info(logOrDefault(e.Logger), "acquired leadership", logging.F(logging.FieldQueue, e.QueueURL))
+}
+
+// createLock sends the lock message if the lock queue seems empty. The count is approximate, but
+// the fixed deduplication id drops lock messages sent by other daemons at the same time, and a
+// surplus lock message is never received while the lock message before it in the group is held.
+func (e *SQSLeaderElector) createLock(ctx context.Context) {
+	n, err := e.lockCount(ctx)
+	if err != nil || n > 0 {
+		return
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:               aws.String(e.QueueURL),
+		MessageBody:            aws.String(leaderLockBody),
+		MessageGroupId:         aws.String(leaderLockID),
+		MessageDeduplicationId: aws.String(leaderLockID),
+	}
+	if _, err := e.sqsClient.SendMessageWithContext(ctx, input); err != nil && ctx.Err() == nil {
+		logging.Error(logOrDefault(e.Logger), "error creating leader lock", logging.F(logging.FieldQueue, e.QueueURL), logging.Err(err))
+	}
+}
+
+// lockCount returns the approximate number of lock messages in the queue, visible or not
+func (e *SQSLeaderElector) lockCount(ctx context.Context) (int, error) {
+	out, err := e.sqsClient.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(e.QueueURL),
+		AttributeNames: aws.StringSlice([]string{
+			sqs.QueueAttributeNameApproximateNumberOfMessages,
+			sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		}),
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			logging.Error(logOrDefault(e.Logger), "error getting attributes of leader lock queue", logging.F(logging.FieldQueue, e.QueueURL), logging.Err(err))
+		}
+		return 0, err
+	}
+
+	total := 0
+	for _, v := range out.Attributes {
+		n, _ := strconv.Atoi(aws.StringValue(v))
+		total += n
+	}
+	return total, nil
+}
+
+func (e *SQSLeaderElector) renew(ctx context.Context) {
+	e.mu.Lock()
+	receiptHandle := e.receiptHandle
+	e.mu.Unlock()
+
+	start := time.Now()
+	_, err := e.sqsClient.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(e.QueueURL),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: aws.Int64(int64(e.TTL / time.Second)),
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			logging.Warn(logOrDefault(e.Logger), "lost leadership, error extending leader lock", logging.F(logging.FieldQueue, e.QueueURL), logging.Err(err))
+			e.mu.Lock()
+			e.receiptHandle = ""
+			e.mu.Unlock()
+		}
+		return
+	}
+
+	e.mu.Lock()
+	e.leaseUntil = start.Add(e.TTL)
+	e.mu.Unlock()
+}
+
+// release makes the lock message visible immediately so another daemon can take over
+func (e *SQSLeaderElector) release() {
+	e.mu.Lock()
+	receiptHandle := e.receiptHandle
+	e.receiptHandle = ""
+	e.mu.Unlock()
+
+	if receiptHandle == "" {
+		return
+	}
+
+	_, err := e.sqsClient.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(e.QueueURL),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: aws.Int64(0),
+	})
+	if err != nil {
+		logging.Error(logOrDefault(e.Logger), "error releasing leader lock", logging.F(logging.FieldQueue, e.QueueURL), logging.Err(err))
+		return
+	}
+	logging.Info(logOrDefault(e.Logger), "released leadership", logging.F(logging.FieldQueue, e.QueueURL))
+}
+
+// MemoryLock is an in-process lock shared by MemoryLeaderElectors, meant for tests and local development
+type MemoryLock struct {
+	mu      sync.Mutex
+	holder  string
+	expires time.Time
+}
+
+func (l *MemoryLock) tryAcquire(id string, ttl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.holder != "" && l.holder != id && now.Before(l.expires) {
+		return false
+	}
+	l.holder = id
+	l.expires = now.Add(ttl)
+	return true
+}
+
+func (l *MemoryLock) heldBy(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder == id && time.Now().Before(l.expires)
+}
+
+func (l *MemoryLock) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder == id {
+		l.holder = ""
+	}
+}
+
+// MemoryLeaderElector is a LeaderElector using a MemoryLock, electors sharing a lock need a unique ID.
+// When an elector stops renewing without releasing, leadership fails over after TTL.
+type MemoryLeaderElector struct {
+	Lock *MemoryLock
+	ID   string
+	TTL  time.Duration
+}
+
+// IsLeader implements LeaderElector
+func (e *MemoryLeaderElector) IsLeader() bool {
+	return e.Lock.heldBy(e.ID)
+}
+
+// Campaign implements LeaderElector
+func (e *MemoryLeaderElector) Campaign(ctx context.Context) {
+	defer e.Lock.release(e.ID)
+	for {
+		e.Lock.tryAcquire(e.ID, e.TTL)
+		if !sleepContext(ctx, e.TTL/3) {
+			return
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package sqsd
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const testLeaderQueueURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/leader.fifo"
+
+// campaign runs e.Campaign until the returned function is called
+func campaign(e LeaderElector) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Campaign(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// leaders returns the electors that are leader
+func leaders(electors ...LeaderElector) []LeaderElector {
+	var l []LeaderElector
+	for _, e := range electors {
+		if e.IsLeader() {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+func TestMemoryLeaderElectorRunsTasksOnce(t *testing.T) {
+	lock := new(MemoryLock)
+	a := &MemoryLeaderElector{Lock: lock, ID: "a", TTL: 300 * time.Millisecond}
+	b := &MemoryLeaderElector{Lock: lock, ID: "b", TTL: 300 * time.Millisecond}
+	stopA := campaign(a)
+	defer stopA()
+	stopB := campaign(b)
+	defer stopB()
+
+	waitFor(t, "a leader", func() bool { return len(leaders(a, b)) == 1 })
+
+	// both daemons share the queue and run the scheduler of the same task
+	src := NewMemorySource("test", 30*time.Second)
+	task := &PeriodicTask{Name: "task", URL: "/task", Schedule: "* * * * *"}
+	if err := task.init(); err != nil {
+		t.Fatal(err)
+	}
+	scheduledAt := time.Now()
+	for _, e := range []LeaderElector{a, b} {
+		c := &Client{Source: src, LeaderElector: e, Logger: logging.Discard, ctx: context.Background()}
+		c.runTask(task, scheduledAt)
+	}
+
+	if n := queueLen(src); n != 1 {
+		t.Errorf("expected 1 queued task, got %d", n)
+	}
+}
+
+func TestMemoryLeaderElectorFailover(t *testing.T) {
+	lock := new(MemoryLock)
+	a := &MemoryLeaderElector{Lock: lock, ID: "a", TTL: 300 * time.Millisecond}
+	b := &MemoryLeaderElector{Lock: lock, ID: "b", TTL: 300 * time.Millisecond}
+
+	stopA := campaign(a)
+	waitFor(t, "a to lead", a.IsLeader)
+	stopB := campaign(b)
+	defer stopB()
+
+	// a stopping releases the lock
+	stopA()
+	waitFor(t, "b to take over after a stopped", b.IsLeader)
+	stopB()
+
+	// an elector that died without releasing keeps the lock until its lease expires
+	if !lock.tryAcquire("crashed", 500*time.Millisecond) {
+		t.Fatal("expected the released lock to be acquired")
+	}
+	start := time.Now()
+	stopA = campaign(a)
+	defer stopA()
+	waitFor(t, "a to take over after the lease expired", a.IsLeader)
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("expected leadership to fail over after the lease expired, got it after %s", d)
+	}
+}
+
+// fakeLockSQS serves the SQS requests of an SQSLeaderElector from a FIFO MemorySource, requests fail when
+// the fake is down
+type fakeLockSQS struct {
+	sqsiface.SQSAPI
+	src *MemorySource
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (f *fakeLockSQS) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+func (f *fakeLockSQS) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (f *fakeLockSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	// a short poll, so the first elector creates the lock without waiting for the 20 seconds of SQS
+	pollCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	msgs, err := f.src.Receive(pollCtx, int(aws.Int64Value(input.MaxNumberOfMessages)))
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+	out := new(sqs.ReceiveMessageOutput)
+	for _, msg := range msgs {
+		out.Messages = append(out.Messages, &sqs.Message{MessageId: aws.String(msg.ID), ReceiptHandle: aws.String(msg.ReceiptHandle)})
+	}
+	return out, nil
+}
+
+func (f *fakeLockSQS) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, _ ...request.Option) (*sqs.SendMessageOutput, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		Body: aws.StringValue(input.MessageBody),
+		Attributes: map[string]string{
+			AttributeMessageGroupID:         aws.StringValue(input.MessageGroupId),
+			AttributeMessageDeduplicationID: aws.StringValue(input.MessageDeduplicationId),
+		},
+	}
+	if err := f.src.Send(ctx, msg, 0); err != nil {
+		return nil, err
+	}
+	return &sqs.SendMessageOutput{MessageId: aws.String(msg.ID)}, nil
+}
+
+func (f *fakeLockSQS) GetQueueAttributesWithContext(ctx aws.Context, input *sqs.GetQueueAttributesInput, _ ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	total, _ := f.src.Len()
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages: aws.String(strconv.Itoa(total)),
+	}}, nil
+}
+
+func (f *fakeLockSQS) ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, _ ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	msg := &Message{ReceiptHandle: aws.StringValue(input.ReceiptHandle)}
+	d := time.Duration(aws.Int64Value(input.VisibilityTimeout)) * time.Second
+	if d == 0 {
+		return new(sqs.ChangeMessageVisibilityOutput), f.src.Nack(ctx, msg, 0)
+	}
+	return new(sqs.ChangeMessageVisibilityOutput), f.src.Extend(ctx, msg, d)
+}
+
+func (f *fakeLockSQS) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	return f.ChangeMessageVisibilityWithContext(context.Background(), input)
+}
+
+func TestSQSLeaderElector(t *testing.T) {
+	const ttl = time.Second
+	src := NewMemorySource("leader.fifo", ttl)
+	src.FIFO = true
+
+	newElector := func() (*SQSLeaderElector, *fakeLockSQS) {
+		fake := &fakeLockSQS{src: src}
+		e := NewSQSLeaderElector(fake, testLeaderQueueURL, ttl)
+		e.Logger = logging.Discard
+		return e, fake
+	}
+	a, fakeA := newElector()
+	b, fakeB := newElector()
+
+	stopA := campaign(a)
+	stopB := campaign(b)
+	defer func() {
+		stopA()
+		stopB()
+	}()
+
+	waitFor(t, "a leader", func() bool { return len(leaders(a, b)) == 1 })
+	if total, _ := src.Len(); total != 1 {
+		t.Errorf("expected a single lock message, got %d", total)
+	}
+	leader, follower, fakeLeader, stopLeader := a, b, fakeA, stopA
+	if b.IsLeader() {
+		leader, follower, fakeLeader, stopLeader = b, a, fakeB, stopB
+	}
+
+	// the leader releases the lock when it stops campaigning
+	stopLeader()
+	waitFor(t, "the follower to take over after the leader stopped", follower.IsLeader)
+	if leader.IsLeader() {
+		t.Error("expected the stopped elector not to be leader")
+	}
+
+	// the lock is taken over when the new leader cannot renew its lease
+	if leader == a {
+		stopA = campaign(a)
+		fakeLeader = fakeB
+	} else {
+		stopB = campaign(b)
+		fakeLeader = fakeA
+	}
+	fakeLeader.setDown(true)
+	waitFor(t, "the first elector to take over after the lease expired", leader.IsLeader)
+	if follower.IsLeader() {
+		t.Error("expected the elector that cannot reach SQS to lose leadership")
+	}
+	if total, _ := src.Len(); total != 1 {
+		t.Errorf("expected a single lock message after the failovers, got %d", total)
+	}
+}
+
+func TestSQSLeaderElectorRequiresFIFOQueue(t *testing.T) {
+	e := NewSQSLeaderElector(&fakeLockSQS{}, "https://sqs.eu-west-1.amazonaws.com/123456789012/leader", time.Second)
+	e.Logger = logging.Discard
+
+	done := make(chan struct{})
+	go func() {
+		e.Campaign(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Campaign to return for a queue that is not a FIFO queue")
+	}
+	if e.IsLeader() {
+		t.Error("expected no leadership without a FIFO queue")
+	}
+}
+
+func TestValidateLeaderQueueURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: testLeaderQueueURL},
+		{url: "https://sqs.eu-west-1.amazonaws.com/123456789012/leader", wantErr: true},
+		{url: "https://sqs.eu-west-1.amazonaws.com/123456789012/leader.fifo.txt", wantErr: true},
+		{url: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		if err := ValidateLeaderQueueURL(test.url); (err != nil) != test.wantErr {
+			t.Errorf("ValidateLeaderQueueURL(%q): expected error %t, got %v", test.url, test.wantErr, err)
+		}
+	}
+}
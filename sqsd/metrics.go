@@ -0,0 +1,198 @@
+package sqsd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+var (
+	// latencyBuckets are the upper bounds in seconds of the delivery duration histogram
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+	// ageBuckets are the upper bounds in seconds of the message age histogram, up to the default retention period
+	ageBuckets = []float64{1, 5, 10, 30, 60, 300, 600, 1800, 3600, 21600, 86400, 345600}
+)
+
+// metrics are the counters of the daemon, exported in the Prometheus text format
+type metrics struct {
+	received  counter
+	delivered counter
+	failed    counter
+	rejected  counter
+	deleted   counter
+
+	deliveryDuration histogram
+	messageAge       histogram
+
+	sqsCalls  counterVec
+	sqsErrors counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		deliveryDuration: histogram{buckets: latencyBuckets},
+		messageAge:       histogram{buckets: ageBuckets},
+	}
+}
+
+// stats returns the metrics of the client, they are created on first use so they can be served before Start
+func (c *Client) stats() *metrics {
+	c.metricsOnce.Do(func() {
+		c.metrics = newMetrics()
+	})
+	return c.metrics
+}
+
+// MetricsHandler returns a handler serving the metrics of the daemon in the Prometheus text format
+func (c *Client) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.writeMetrics(w)
+	})
+}
+
+func (c *Client) writeMetrics(w io.Writer) {
+	m := c.stats()
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	writeMetric(bw, "sqsd_messages_received_total", "counter", "Messages received from the queue.", m.received.Get())
+	writeMetric(bw, "sqsd_messages_delivered_total", "counter", "Messages delivered to the HTTP endpoint.", m.delivered.Get())
+	writeMetric(bw, "sqsd_messages_failed_total", "counter", "Failed deliveries to the HTTP endpoint.", m.failed.Get())
+	writeMetric(bw, "sqsd_messages_rejected_total", "counter", "Messages not retried because of a permanent failure response.", m.rejected.Get())
+	writeMetric(bw, "sqsd_messages_deleted_total", "counter", "Messages deleted from the queue.", m.deleted.Get())
+
+	writeMetric(bw, "sqsd_deliveries_in_flight", "gauge", "Deliveries waiting for the HTTP endpoint.", c.openRequests.Get())
+
+	m.deliveryDuration.write(bw, "sqsd_delivery_duration_seconds", "Duration of HTTP deliveries by status code, code is error when there was no response.", "code")
+	m.messageAge.write(bw, "sqsd_message_age_seconds", "Time between sending a message to the queue and its delivery.", "")
+
+	m.sqsCalls.write(bw, "sqsd_sqs_api_calls_total", "Calls to the SQS API by operation.", "operation")
+	m.sqsErrors.write(bw, "sqsd_sqs_api_errors_total", "Failed calls to the SQS API by operation.", "operation")
+}
+
+// instrumentSQS counts the calls and errors of all operations of an SQS client
+func (c *Client) instrumentSQS(handlers *request.Handlers) {
+	handlers.Complete.PushBack(func(r *request.Request) {
+		m := c.stats()
+		m.sqsCalls.add(r.Operation.Name)
+		if r.Error != nil {
+			m.sqsErrors.add(r.Operation.Name)
+		}
+	})
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, value)
+}
+
+// labels formats a label set, value is empty without a label name
+func labels(name, value string, extra ...string) string {
+	var pairs []string
+	if name != "" {
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// counterVec is a counter with one label
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]int
+}
+
+func (v *counterVec) add(label string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.values == nil {
+		v.values = make(map[string]int)
+	}
+	v.values[label]++
+}
+
+func (v *counterVec) write(w io.Writer, name, help, labelName string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, label := range sortedLabels(v.values) {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels(labelName, label), v.values[label])
+	}
+}
+
+// histogram is a histogram with at most one label
+type histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []int
+	count  int
+	sum    float64
+}
+
+func (h *histogram) observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*histogramSeries)
+	}
+	s := h.series[label]
+	if s == nil {
+		s = &histogramSeries{counts: make([]int, len(h.buckets))}
+		h.series[label] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, help, labelName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	labelValues := make([]string, 0, len(h.series))
+	for label := range h.series {
+		labelValues = append(labelValues, label)
+	}
+	sort.Strings(labelValues)
+
+	for _, label := range labelValues {
+		s := h.series[label]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(labelName, label, `le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels(labelName, label, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labels(labelName, label), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels(labelName, label), s.count)
+	}
+}
+
+func sortedLabels(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,76 @@
+package sqsd
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+// pauser keeps the reasons receiving is paused for, receiving continues when there are none
+type pauser struct {
+	mu      sync.Mutex
+	reasons map[string]bool
+	// change is closed and replaced when receiving is paused or continues
+	change chan struct{}
+}
+
+func (p *pauser) set(reason string, paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.reasons == nil {
+		p.reasons = make(map[string]bool)
+	}
+	wasPaused := len(p.reasons) > 0
+	if paused {
+		p.reasons[reason] = true
+	} else {
+		delete(p.reasons, reason)
+	}
+
+	if wasPaused != (len(p.reasons) > 0) {
+		close(p.changeChan())
+		p.change = make(chan struct{})
+	}
+}
+
+// state returns the sorted pause reasons and a channel that is closed when receiving is paused or continues
+func (p *pauser) state() ([]string, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reasons := make([]string, 0, len(p.reasons))
+	for reason := range p.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons, p.changeChan()
+}
+
+// changeChan returns the change channel, p.mu must be held
+func (p *pauser) changeChan() chan struct{} {
+	if p.change == nil {
+		p.change = make(chan struct{})
+	}
+	return p.change
+}
+
+// Pause stops receiving messages until Resume is called with the same reason, deliveries in progress continue.
+// A long poll in progress is cancelled. When paused for multiple reasons receiving continues when all are resumed.
+func (c *Client) Pause(reason string) {
+	logging.Info(c.log(), "pausing receiving messages", logging.F("reason", reason))
+	c.pauser.set(reason, true)
+}
+
+// Resume continues receiving messages paused for reason
+func (c *Client) Resume(reason string) {
+	logging.Info(c.log(), "resuming receiving messages", logging.F("reason", reason))
+	c.pauser.set(reason, false)
+}
+
+// Paused returns the reasons receiving messages is paused for
+func (c *Client) Paused() []string {
+	reasons, _ := c.pauser.state()
+	return reasons
+}
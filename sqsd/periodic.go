@@ -0,0 +1,157 @@
+package sqsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/internal/yaml"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+// Message attributes used by Elastic Beanstalk to mark periodic task messages
+const (
+	attrTaskName      = "beanstalk.sqsd.task_name"
+	attrTaskPath      = "beanstalk.sqsd.path"
+	attrScheduledTime = "beanstalk.sqsd.scheduled_time"
+
+	periodicTaskBody = "elasticbeanstalk scheduled job"
+)
+
+// PeriodicTask is a scheduled task as defined in the cron.yaml file of an Elastic Beanstalk worker
+// See https://docs.aws.amazon.com/elasticbeanstalk/latest/dg/using-features-managing-env-tiers.html#worker-periodictasks
+type PeriodicTask struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Schedule string `json:"schedule"`
+	// Timezone is the IANA time zone the schedule is evaluated in, UTC when empty
+	Timezone string `json:"timezone"`
+
+	schedule *cronSchedule
+	location *time.Location
+}
+
+type cronFile struct {
+	Version int             `json:"version"`
+	Cron    []*PeriodicTask `json:"cron"`
+}
+
+// ParseCronFile reads the periodic tasks from a cron.yaml file
+func ParseCronFile(filename string) ([]*PeriodicTask, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cron file: %s", err)
+	}
+
+	cf := new(cronFile)
+	if err := yaml.Unmarshal(b, cf); err != nil {
+		return nil, fmt.Errorf("error parsing cron file %s: %s", filename, err)
+	}
+	if cf.Version != 1 {
+		return nil, fmt.Errorf("error parsing cron file %s: unsupported version %d", filename, cf.Version)
+	}
+
+	for _, task := range cf.Cron {
+		if err := task.init(); err != nil {
+			return nil, fmt.Errorf("error in cron file %s: %s", filename, err)
+		}
+	}
+	return cf.Cron, nil
+}
+
+func (t *PeriodicTask) init() error {
+	if t.Name == "" {
+		return fmt.Errorf("periodic task without name")
+	}
+	if t.URL == "" {
+		return fmt.Errorf("periodic task %s has no url", t.Name)
+	}
+	if _, err := url.Parse(t.URL); err != nil {
+		return fmt.Errorf("periodic task %s has an invalid url: %s", t.Name, err)
+	}
+
+	var err error
+	if t.schedule, err = parseCronExpression(t.Schedule); err != nil {
+		return fmt.Errorf("periodic task %s: %s", t.Name, err)
+	}
+	if t.location, err = time.LoadLocation(t.Timezone); err != nil {
+		return fmt.Errorf("periodic task %s has an invalid timezone: %s", t.Name, err)
+	}
+	return nil
+}
+
+// Next returns the first time after t the task is scheduled to run
+func (t *PeriodicTask) Next(after time.Time) time.Time {
+	return t.schedule.next(after.In(t.location))
+}
+
+// scheduler sends a message to the queue each time the task is due
+func (c *Client) scheduler(task *PeriodicTask) {
+
+	taskField := logging.F(logging.FieldTask, task.Name)
+	logging.Debug(c.log(), "scheduling periodic task", taskField, logging.F("schedule", task.Schedule))
+
+	for {
+		next := task.Next(time.Now())
+		if next.IsZero() {
+			logging.Warn(c.log(), "periodic task will never run again, stopping its scheduler", taskField)
+			return
+		}
+
+		if !sleepContext(c.ctx, time.Until(next)) {
+			return
+		}
+
+		c.runTask(task, next)
+	}
+}
+
+// runTask queues the task scheduled at scheduledAt when this daemon is the leader
+func (c *Client) runTask(task *PeriodicTask, scheduledAt time.Time) {
+	taskField := logging.F(logging.FieldTask, task.Name)
+	if c.LeaderElector != nil && !c.LeaderElector.IsLeader() {
+		logging.Debug(c.log(), "not the leader, skipping periodic task", taskField)
+		return
+	}
+
+	if err := c.enqueueTask(task, scheduledAt); err != nil {
+		logging.Error(c.log(), "error queueing periodic task", taskField, logging.Err(err))
+	}
+}
+
+func (c *Client) enqueueTask(task *PeriodicTask, scheduledAt time.Time) error {
+	err := c.Source.(Sender).Send(c.ctx, &Message{
+		Body: periodicTaskBody,
+		// on FIFO queues the deduplication id prevents duplicate tasks when several daemons queue them
+		Attributes: map[string]string{
+			AttributeMessageGroupID:         task.Name,
+			AttributeMessageDeduplicationID: task.Name + "-" + strconv.FormatInt(scheduledAt.Unix(), 10),
+		},
+		MessageAttributes: map[string]*MessageAttribute{
+			attrTaskName:      stringAttribute(task.Name),
+			attrTaskPath:      stringAttribute(task.URL),
+			attrScheduledTime: stringAttribute(scheduledAt.UTC().Format(time.RFC3339)),
+		},
+	}, 0)
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(c.log(), "periodic task queued", logging.F(logging.FieldTask, task.Name), logging.F("scheduled_at", scheduledAt))
+	return nil
+}
+
+// taskURL resolves the path of a periodic task against HTTPURL
+func (c *Client) taskURL(path string) (string, error) {
+	base, err := url.Parse(c.HTTPURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
@@ -0,0 +1,122 @@
+package sqsd
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Source is a queue the daemon receives messages from
+type Source interface {
+	// QueueName is sent to the HTTP endpoint in the X-Aws-Sqsd-Queue header
+	QueueName() string
+	// Receive waits for messages and returns at most max messages, which stay invisible
+	// for other receivers until they are acknowledged or their visibility timeout expires
+	Receive(ctx context.Context, max int) ([]*Message, error)
+	// Ack deletes a successfully delivered message
+	Ack(ctx context.Context, msg *Message) error
+	// Nack makes a message visible again after delay
+	Nack(ctx context.Context, msg *Message, delay time.Duration) error
+	// Extend keeps a message invisible for d from now
+	Extend(ctx context.Context, msg *Message, d time.Duration) error
+	// Close is called when the daemon stops, pending acknowledgements should be flushed
+	Close(ctx context.Context) error
+}
+
+// Sender is implemented by sources that can queue new messages, it is required for periodic tasks.
+// A Sender is also used as dead-letter queue.
+type Sender interface {
+	// Send queues the body and message attributes of msg, it becomes visible after delay.
+	// FIFO queues use the MessageGroupId and MessageDeduplicationId of the Attributes of msg.
+	// The ID of msg is set to the ID of the new message when the queue assigns one.
+	Send(ctx context.Context, msg *Message, delay time.Duration) error
+}
+
+// deleteNotifier is a Source that deletes acknowledged messages asynchronously, f is called when a message is
+// actually deleted so Ack returning nil does not mean the message was deleted
+type deleteNotifier interface {
+	notifyDeleted(f func(*Message))
+}
+
+// Message is a message received from a Source
+type Message struct {
+	ID   string
+	Body string
+	// ReceiptHandle identifies this receive of the message to the source
+	ReceiptHandle string
+	// Attributes are the system attributes using the SQS names, like ApproximateReceiveCount and SentTimestamp
+	Attributes        map[string]string
+	MessageAttributes map[string]*MessageAttribute
+}
+
+// MessageAttribute is a custom message attribute, BinaryValue is used when DataType starts with Binary
+type MessageAttribute struct {
+	DataType    string `json:"DataType"`
+	StringValue string `json:"StringValue,omitempty"`
+	BinaryValue []byte `json:"BinaryValue,omitempty"`
+}
+
+// System attributes sources should set on received messages
+const (
+	AttributeApproximateReceiveCount          = "ApproximateReceiveCount"
+	AttributeApproximateFirstReceiveTimestamp = "ApproximateFirstReceiveTimestamp"
+	AttributeSentTimestamp                    = "SentTimestamp"
+)
+
+// System attributes of messages in FIFO queues, messages with the same group id are delivered one at a time in order
+const (
+	AttributeMessageGroupID         = "MessageGroupId"
+	AttributeMessageDeduplicationID = "MessageDeduplicationId"
+	AttributeSequenceNumber         = "SequenceNumber"
+)
+
+// ReceiveCount returns the number of times the message was received, 0 when unknown
+func (m *Message) ReceiveCount() int {
+	n, _ := strconv.Atoi(m.Attributes[AttributeApproximateReceiveCount])
+	return n
+}
+
+// GroupID returns the message group id of a message from a FIFO queue, an empty string for other messages
+func (m *Message) GroupID() string {
+	return m.Attributes[AttributeMessageGroupID]
+}
+
+// SentAt returns the time the message was sent to the queue, a zero time when unknown
+func (m *Message) SentAt() time.Time {
+	return m.timestamp(AttributeSentTimestamp)
+}
+
+// FirstReceivedAt returns the time the message was first received, a zero time when unknown
+func (m *Message) FirstReceivedAt() time.Time {
+	return m.timestamp(AttributeApproximateFirstReceiveTimestamp)
+}
+
+func (m *Message) timestamp(attr string) time.Time {
+	ms, err := strconv.ParseInt(m.Attributes[attr], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// copyAttributes returns a deep copy of message attributes
+func copyAttributes(attrs map[string]*MessageAttribute) map[string]*MessageAttribute {
+	if attrs == nil {
+		return nil
+	}
+	cp := make(map[string]*MessageAttribute, len(attrs))
+	for name, attr := range attrs {
+		a := *attr
+		a.BinaryValue = append([]byte(nil), attr.BinaryValue...)
+		cp[name] = &a
+	}
+	return cp
+}
+
+func stringAttribute(s string) *MessageAttribute {
+	return &MessageAttribute{DataType: "String", StringValue: s}
+}
+
+func timestampMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
@@ -0,0 +1,224 @@
+package sqsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileEnvelopeExt is the extension of files holding a JSON encoded body and message attributes
+	fileEnvelopeExt = ".sqsd.json"
+	// filePollInterval is how often Receive looks for new files
+	filePollInterval = time.Second
+)
+
+// FileSource uses the files in a directory as queue, for development without AWS.
+// Every file is a message with the file contents as body, except files ending in .sqsd.json
+// which hold a JSON object with a body and message attributes, as written by Send.
+// Files are processed in order of modification time and removed when delivered.
+// Receive counts and visibility timeouts are kept in memory. Messages have no SentTimestamp,
+// the modification time of a file says nothing about when it was queued, so files never expire.
+type FileSource struct {
+	Dir               string
+	VisibilityTimeout time.Duration
+
+	mu    sync.Mutex
+	state map[string]*fileState
+}
+
+type fileState struct {
+	visibleAt     time.Time
+	firstReceive  time.Time
+	receiveCount  int
+	receiptHandle string
+}
+
+type fileEnvelope struct {
+	Body              string                       `json:"body"`
+	MessageAttributes map[string]*MessageAttribute `json:"attributes,omitempty"`
+}
+
+// NewFileSource returns a Source reading messages from the files in dir
+func NewFileSource(dir string, visibilityTimeout time.Duration) *FileSource {
+	return &FileSource{
+		Dir:               dir,
+		VisibilityTimeout: visibilityTimeout,
+		state:             make(map[string]*fileState),
+	}
+}
+
+// QueueName implements Source, it is the name of the directory
+func (s *FileSource) QueueName() string {
+	return filepath.Base(s.Dir)
+}
+
+// Receive implements Source, it waits at most 20 seconds for new files
+func (s *FileSource) Receive(ctx context.Context, max int) ([]*Message, error) {
+	deadline := time.Now().Add(memoryWaitTime)
+	for {
+		msgs, err := s.receive(max)
+		if err != nil || len(msgs) > 0 || time.Now().After(deadline) {
+			return msgs, err
+		}
+		if !sleepContext(ctx, filePollInterval) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *FileSource) receive(max int) ([]*Message, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading message directory: %s", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var msgs []*Message
+	for _, fi := range files {
+		if len(msgs) == max {
+			break
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		st := s.state[fi.Name()]
+		if st == nil {
+			st = new(fileState)
+			s.state[fi.Name()] = st
+		}
+		if st.visibleAt.After(now) {
+			continue
+		}
+
+		msg, err := s.read(fi.Name())
+		if err != nil {
+			return msgs, err
+		}
+
+		st.receiveCount++
+		if st.firstReceive.IsZero() {
+			st.firstReceive = now
+		}
+		st.visibleAt = now.Add(s.VisibilityTimeout)
+		st.receiptHandle = fi.Name() + "#" + newMessageID()
+
+		msg.ReceiptHandle = st.receiptHandle
+		msg.Attributes = map[string]string{
+			AttributeApproximateReceiveCount:          fmt.Sprint(st.receiveCount),
+			AttributeApproximateFirstReceiveTimestamp: timestampMillis(st.firstReceive),
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (s *FileSource) read(name string) (*Message, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading message file: %s", err)
+	}
+
+	msg := &Message{ID: name}
+	if !strings.HasSuffix(name, fileEnvelopeExt) {
+		msg.Body = string(b)
+		return msg, nil
+	}
+
+	env := new(fileEnvelope)
+	if err := json.Unmarshal(b, env); err != nil {
+		return nil, fmt.Errorf("error decoding message file %s: %s", name, err)
+	}
+	msg.Body = env.Body
+	msg.MessageAttributes = env.MessageAttributes
+	return msg, nil
+}
+
+// Ack implements Source, it removes the file
+func (s *FileSource) Ack(ctx context.Context, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, err := s.find(msg)
+	if err != nil {
+		return err
+	}
+	delete(s.state, name)
+	return os.Remove(filepath.Join(s.Dir, name))
+}
+
+// Nack implements Source
+func (s *FileSource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	return s.setVisibleAt(msg, time.Now().Add(delay))
+}
+
+// Extend implements Source
+func (s *FileSource) Extend(ctx context.Context, msg *Message, d time.Duration) error {
+	return s.setVisibleAt(msg, time.Now().Add(d))
+}
+
+// Close implements Source
+func (s *FileSource) Close(ctx context.Context) error {
+	return nil
+}
+
+// Send implements Sender, it writes the message to a new file which is used after delay
+func (s *FileSource) Send(ctx context.Context, msg *Message, delay time.Duration) error {
+	b, err := json.Marshal(&fileEnvelope{Body: msg.Body, MessageAttributes: msg.MessageAttributes})
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s%s", time.Now().UnixNano(), newMessageID()[:8], fileEnvelopeExt)
+	if delay > 0 {
+		s.mu.Lock()
+		s.state[name] = &fileState{visibleAt: time.Now().Add(delay)}
+		s.mu.Unlock()
+	}
+
+	// write to a hidden file first so a partial file is never received
+	tmp := filepath.Join(s.Dir, "."+name)
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Dir, name)); err != nil {
+		return err
+	}
+	msg.ID = name
+	return nil
+}
+
+func (s *FileSource) setVisibleAt(msg *Message, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, err := s.find(msg)
+	if err != nil {
+		return err
+	}
+	s.state[name].visibleAt = t
+	return nil
+}
+
+// find returns the file name of the message with the receipt handle of msg, s.mu must be held
+func (s *FileSource) find(msg *Message) (string, error) {
+	name := msg.ReceiptHandle
+	if i := strings.LastIndex(name, "#"); i >= 0 {
+		name = name[:i]
+	}
+	if st := s.state[name]; st != nil && st.receiptHandle == msg.ReceiptHandle && msg.ReceiptHandle != "" {
+		return name, nil
+	}
+	return "", fmt.Errorf("receipt handle of message %s is invalid or expired", msg.ID)
+}
@@ -0,0 +1,44 @@
+package sqsd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSourceOldFilesDoNotExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "old.json")
+	if err := ioutil.WriteFile(file, []byte(`{"job":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewFileSource(dir, time.Minute)
+	msgs, err := src.Receive(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("received %d messages, want 1", len(msgs))
+	}
+
+	c := &Client{RetentionPeriod: 345600}
+	if c.expired(msgs[0]) {
+		t.Errorf("a file modified at %s is expired", old)
+	}
+	if msgs[0].Body != `{"job":1}` || msgs[0].ReceiveCount() != 1 {
+		t.Errorf("unexpected message %+v", msgs[0])
+	}
+}
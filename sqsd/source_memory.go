@@ -0,0 +1,302 @@
+package sqsd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// memoryWaitTime is the maximum time Receive waits for messages, like SQS long polling
+	memoryWaitTime = 20 * time.Second
+
+	// memoryDeduplicationInterval is the time a FIFO queue drops messages with the same deduplication id, like SQS
+	memoryDeduplicationInterval = 5 * time.Minute
+)
+
+// MemorySource is an in-memory queue with visibility timeouts and receive counts,
+// for tests and development without AWS
+type MemorySource struct {
+	Name              string
+	VisibilityTimeout time.Duration
+
+	// FIFO queues need the MessageGroupId attribute on sent messages, a group is not received while one of its
+	// messages is in flight. Messages with the MessageDeduplicationId of a message sent in the last 5 minutes are
+	// dropped, with ContentBasedDeduplication a hash of the body is used when there is no deduplication id.
+	FIFO                      bool
+	ContentBasedDeduplication bool
+
+	mu       sync.Mutex
+	messages []*memoryMessage
+	notify   chan struct{}
+	// sent are the ids of the messages of a FIFO queue by deduplication id
+	sent     map[string]*memoryMessage
+	sequence int64
+}
+
+type memoryMessage struct {
+	msg          Message
+	sentAt       time.Time
+	visibleAt    time.Time
+	firstReceive time.Time
+	receiveCount int
+
+	// the system attributes of messages of a FIFO queue
+	groupID, deduplicationID, sequenceNumber string
+}
+
+// NewMemorySource returns an empty in-memory queue
+func NewMemorySource(name string, visibilityTimeout time.Duration) *MemorySource {
+	return &MemorySource{
+		Name:              name,
+		VisibilityTimeout: visibilityTimeout,
+	}
+}
+
+// QueueName implements Source
+func (s *MemorySource) QueueName() string {
+	return s.Name
+}
+
+// Len returns the number of messages in the queue and the number of those that are invisible
+func (s *MemorySource) Len() (total int, inFlight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, m := range s.messages {
+		if m.visibleAt.After(now) {
+			inFlight++
+		}
+	}
+	return len(s.messages), inFlight
+}
+
+// Send implements Sender, the SequenceNumber attribute of a message sent to a FIFO queue is set
+func (s *MemorySource) Send(ctx context.Context, msg *Message, delay time.Duration) error {
+	now := time.Now()
+	m := &memoryMessage{
+		msg: Message{
+			ID:                newMessageID(),
+			Body:              msg.Body,
+			MessageAttributes: copyAttributes(msg.MessageAttributes),
+		},
+		sentAt:    now,
+		visibleAt: now.Add(delay),
+	}
+
+	if s.FIFO {
+		m.groupID = msg.Attributes[AttributeMessageGroupID]
+		if m.groupID == "" {
+			return fmt.Errorf("a message group id is required for FIFO queue %s", s.Name)
+		}
+		m.deduplicationID = msg.Attributes[AttributeMessageDeduplicationID]
+		if m.deduplicationID == "" && s.ContentBasedDeduplication {
+			sum := sha256.Sum256([]byte(msg.Body))
+			m.deduplicationID = hex.EncodeToString(sum[:])
+		}
+		if m.deduplicationID == "" {
+			return fmt.Errorf("a message deduplication id is required for FIFO queue %s without content-based deduplication", s.Name)
+		}
+	}
+
+	s.mu.Lock()
+	if s.FIFO {
+		if sent := s.sent[m.deduplicationID]; sent != nil && now.Sub(sent.sentAt) < memoryDeduplicationInterval {
+			s.mu.Unlock()
+			msg.ID = sent.msg.ID
+			msg.Attributes[AttributeSequenceNumber] = sent.sequenceNumber
+			return nil
+		}
+		s.sequence++
+		m.sequenceNumber = fmt.Sprintf("%020d", s.sequence)
+		s.remember(m, now)
+	}
+	s.messages = append(s.messages, m)
+	s.mu.Unlock()
+
+	msg.ID = m.msg.ID
+	if s.FIFO {
+		msg.Attributes[AttributeSequenceNumber] = m.sequenceNumber
+	}
+	s.wakeup()
+	return nil
+}
+
+// remember adds a message of a FIFO queue to the sent messages and forgets the ones older than the
+// deduplication interval, s.mu must be held
+func (s *MemorySource) remember(m *memoryMessage, now time.Time) {
+	if s.sent == nil {
+		s.sent = make(map[string]*memoryMessage)
+	}
+	for id, sent := range s.sent {
+		if now.Sub(sent.sentAt) >= memoryDeduplicationInterval {
+			delete(s.sent, id)
+		}
+	}
+	s.sent[m.deduplicationID] = m
+}
+
+// Receive implements Source, it waits at most 20 seconds for messages
+func (s *MemorySource) Receive(ctx context.Context, max int) ([]*Message, error) {
+	deadline := time.Now().Add(memoryWaitTime)
+	for {
+		s.mu.Lock()
+		msgs, wait := s.receive(max)
+		notify := s.notifyChan()
+		s.mu.Unlock()
+
+		if len(msgs) > 0 {
+			return msgs, nil
+		}
+
+		if untilDeadline := time.Until(deadline); wait == 0 || wait > untilDeadline {
+			wait = untilDeadline
+		}
+		if wait <= 0 {
+			return nil, nil
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-notify:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// receive returns the visible messages, or the time until the next message becomes visible.
+// s.mu must be held.
+func (s *MemorySource) receive(max int) ([]*Message, time.Duration) {
+	now := time.Now()
+	var (
+		msgs []*Message
+		wait time.Duration
+		// blocked are the message groups of a FIFO queue with a message in flight
+		blocked = make(map[string]bool)
+	)
+	for _, m := range s.messages {
+		if m.visibleAt.After(now) {
+			if d := m.visibleAt.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+			if s.FIFO {
+				blocked[m.groupID] = true
+			}
+			continue
+		}
+		if blocked[m.groupID] {
+			continue
+		}
+		if len(msgs) == max {
+			break
+		}
+
+		m.receiveCount++
+		if m.firstReceive.IsZero() {
+			m.firstReceive = now
+		}
+		m.visibleAt = now.Add(s.VisibilityTimeout)
+		// a new receipt handle for every receive, so a stale receiver cannot delete the message
+		m.msg.ReceiptHandle = newMessageID()
+
+		msg := m.msg
+		msg.MessageAttributes = copyAttributes(m.msg.MessageAttributes)
+		msg.Attributes = map[string]string{
+			AttributeApproximateReceiveCount:          fmt.Sprint(m.receiveCount),
+			AttributeApproximateFirstReceiveTimestamp: timestampMillis(m.firstReceive),
+			AttributeSentTimestamp:                    timestampMillis(m.sentAt),
+		}
+		if s.FIFO {
+			msg.Attributes[AttributeMessageGroupID] = m.groupID
+			msg.Attributes[AttributeMessageDeduplicationID] = m.deduplicationID
+			msg.Attributes[AttributeSequenceNumber] = m.sequenceNumber
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, wait
+}
+
+// Ack implements Source
+func (s *MemorySource) Ack(ctx context.Context, msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, err := s.find(msg)
+	if err != nil {
+		return err
+	}
+	s.messages = append(s.messages[:i], s.messages[i+1:]...)
+	return nil
+}
+
+// Nack implements Source
+func (s *MemorySource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	if err := s.setVisibleAt(msg, time.Now().Add(delay)); err != nil {
+		return err
+	}
+	s.wakeup()
+	return nil
+}
+
+// Extend implements Source
+func (s *MemorySource) Extend(ctx context.Context, msg *Message, d time.Duration) error {
+	return s.setVisibleAt(msg, time.Now().Add(d))
+}
+
+// Close implements Source
+func (s *MemorySource) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemorySource) setVisibleAt(msg *Message, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, err := s.find(msg)
+	if err != nil {
+		return err
+	}
+	s.messages[i].visibleAt = t
+	return nil
+}
+
+// find returns the index of the message with the receipt handle of msg, s.mu must be held
+func (s *MemorySource) find(msg *Message) (int, error) {
+	for i, m := range s.messages {
+		if m.msg.ReceiptHandle == msg.ReceiptHandle && msg.ReceiptHandle != "" {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("receipt handle of message %s is invalid or expired", msg.ID)
+}
+
+// wakeup signals waiting receivers that messages may be available
+func (s *MemorySource) wakeup() {
+	s.mu.Lock()
+	close(s.notifyChan())
+	s.notify = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// notifyChan returns the channel that is closed when messages are added, s.mu must be held
+func (s *MemorySource) notifyChan() chan struct{} {
+	if s.notify == nil {
+		s.notify = make(chan struct{})
+	}
+	return s.notify
+}
+
+// newMessageID returns a random UUID
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,253 @@
+package sqsd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	// receiveAttemptTTL is the time SQS accepts a ReceiveRequestAttemptId for a retry
+	receiveAttemptTTL = 5 * time.Minute
+
+	// defaultMessageGroupID is the group of messages sent to a FIFO queue without a group id
+	defaultMessageGroupID = "default"
+)
+
+// SQSSource receives messages from an Amazon SQS queue, delivered messages are deleted in batches.
+// For FIFO queues failed receives are retried with the same ReceiveRequestAttemptId, so SQS returns
+// the messages it already made invisible for that attempt.
+type SQSSource struct {
+	QueueURL string
+	// VisibilityTimeout in seconds for received messages, 0 uses the queue default
+	VisibilityTimeout int
+	// Logger receives the log entries of the queue, when it is nil they are written as text to stderr
+	Logger logging.Logger
+
+	sqsClient sqsiface.SQSAPI
+	// deleted is called for every message the deleter deleted
+	deleted func(*Message)
+
+	mu sync.Mutex
+	// deleter is started by the first Ack, closed is set by Close
+	deleter *deleter
+	closed  bool
+	// failedAttempts are the receive attempts of a FIFO queue to retry
+	failedAttempts []*receiveAttempt
+}
+
+type receiveAttempt struct {
+	id      string
+	max     int
+	started time.Time
+}
+
+// NewSQSSource returns a Source for the SQS queue with queueURL
+func NewSQSSource(sqsClient sqsiface.SQSAPI, queueURL string, visibilityTimeout int) *SQSSource {
+	return &SQSSource{
+		QueueURL:          queueURL,
+		VisibilityTimeout: visibilityTimeout,
+		sqsClient:         sqsClient,
+	}
+}
+
+// messageLog returns the logger with the fields of msg
+func (s *SQSSource) messageLog(msg *Message) logging.Logger {
+	return logging.With(logOrDefault(s.Logger),
+		logging.F(logging.FieldMessageID, msg.ID),
+		logging.F(logging.FieldQueue, s.QueueName()),
+	)
+}
+
+// QueueName implements Source, it is the last part of the queue URL
+func (s *SQSSource) QueueName() string {
+	return s.QueueURL[strings.LastIndex(s.QueueURL, "/")+1:]
+}
+
+// FIFO reports whether the queue is a FIFO queue, the names of FIFO queues end with .fifo
+func (s *SQSSource) FIFO() bool {
+	return strings.HasSuffix(s.QueueURL, ".fifo")
+}
+
+// receiveAttempt returns a failed receive attempt to retry, or a new attempt for max messages
+func (s *SQSSource) receiveAttempt(max int) *receiveAttempt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.failedAttempts) > 0 {
+		a := s.failedAttempts[0]
+		if time.Since(a.started) > receiveAttemptTTL {
+			s.failedAttempts = s.failedAttempts[1:]
+			continue
+		}
+		if a.max > max {
+			break
+		}
+		s.failedAttempts = s.failedAttempts[1:]
+		return a
+	}
+	return &receiveAttempt{id: newMessageID(), max: max, started: time.Now()}
+}
+
+func (s *SQSSource) retryAttempt(a *receiveAttempt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedAttempts = append(s.failedAttempts, a)
+}
+
+// Receive implements Source using long polling
+func (s *SQSSource) Receive(ctx context.Context, max int) ([]*Message, error) {
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(s.QueueURL),
+		MaxNumberOfMessages:   aws.Int64(int64(max)),
+		WaitTimeSeconds:       aws.Int64(20),
+		AttributeNames:        aws.StringSlice([]string{AttributeApproximateFirstReceiveTimestamp, AttributeApproximateReceiveCount, AttributeSentTimestamp}),
+		MessageAttributeNames: aws.StringSlice([]string{"All"}),
+	}
+	if s.VisibilityTimeout > 0 {
+		input.VisibilityTimeout = aws.Int64(int64(s.VisibilityTimeout))
+	}
+
+	var attempt *receiveAttempt
+	if s.FIFO() {
+		attempt = s.receiveAttempt(max)
+		input.MaxNumberOfMessages = aws.Int64(int64(attempt.max))
+		input.ReceiveRequestAttemptId = aws.String(attempt.id)
+		input.AttributeNames = append(input.AttributeNames, aws.StringSlice([]string{AttributeMessageGroupID, AttributeMessageDeduplicationID, AttributeSequenceNumber})...)
+	}
+
+	out, err := s.sqsClient.ReceiveMessageWithContext(ctx, input)
+	if err != nil {
+		// messages received by a cancelled attempt become visible after their visibility timeout
+		if attempt != nil && ctx.Err() == nil {
+			s.retryAttempt(attempt)
+		}
+		return nil, err
+	}
+
+	msgs := make([]*Message, len(out.Messages))
+	for i, m := range out.Messages {
+		msgs[i] = &Message{
+			ID:                aws.StringValue(m.MessageId),
+			Body:              aws.StringValue(m.Body),
+			ReceiptHandle:     aws.StringValue(m.ReceiptHandle),
+			Attributes:        aws.StringValueMap(m.Attributes),
+			MessageAttributes: make(map[string]*MessageAttribute, len(m.MessageAttributes)),
+		}
+		for name, attr := range m.MessageAttributes {
+			msgs[i].MessageAttributes[name] = &MessageAttribute{
+				DataType:    aws.StringValue(attr.DataType),
+				StringValue: aws.StringValue(attr.StringValue),
+				BinaryValue: attr.BinaryValue,
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// Ack implements Source, the message is deleted in the next DeleteMessageBatch call.
+// An error is returned when the queue is closed.
+func (s *SQSSource) Ack(ctx context.Context, msg *Message) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("message not deleted, the queue is closed")
+	}
+	if s.deleter == nil {
+		s.deleter = newDeleter(s)
+	}
+	d := s.deleter
+	s.mu.Unlock()
+
+	return d.delete(msg)
+}
+
+// notifyDeleted implements deleteNotifier, it must be called before the first Ack
+func (s *SQSSource) notifyDeleted(f func(*Message)) {
+	s.deleted = f
+}
+
+// Nack implements Source
+func (s *SQSSource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	return s.changeVisibility(ctx, msg, delay)
+}
+
+// Extend implements Source
+func (s *SQSSource) Extend(ctx context.Context, msg *Message, d time.Duration) error {
+	return s.changeVisibility(ctx, msg, d)
+}
+
+func (s *SQSSource) changeVisibility(ctx context.Context, msg *Message, d time.Duration) error {
+	_, err := s.sqsClient.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(s.QueueURL),
+		ReceiptHandle:     aws.String(msg.ReceiptHandle),
+		VisibilityTimeout: aws.Int64(int64(d / time.Second)),
+	})
+	if err != nil {
+		return err
+	}
+
+	logging.Debug(s.messageLog(msg), "visibility timeout of message set", logging.F(logging.FieldDuration, d))
+	return nil
+}
+
+// Close implements Source, it sends the pending deletes. Messages acknowledged after Close are not deleted.
+func (s *SQSSource) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	d := s.deleter
+	s.mu.Unlock()
+
+	if d == nil {
+		return nil
+	}
+	return d.stop(ctx)
+}
+
+// Send implements Sender
+func (s *SQSSource) Send(ctx context.Context, msg *Message, delay time.Duration) error {
+	input := &sqs.SendMessageInput{
+		QueueUrl:     aws.String(s.QueueURL),
+		MessageBody:  aws.String(msg.Body),
+		DelaySeconds: aws.Int64(int64(delay / time.Second)),
+	}
+	if s.FIFO() {
+		if delay > 0 {
+			return fmt.Errorf("FIFO queues do not support a delay per message")
+		}
+		input.DelaySeconds = nil
+		groupID := msg.GroupID()
+		if groupID == "" {
+			groupID = defaultMessageGroupID
+		}
+		input.MessageGroupId = aws.String(groupID)
+		if id := msg.Attributes[AttributeMessageDeduplicationID]; id != "" {
+			input.MessageDeduplicationId = aws.String(id)
+		}
+	}
+	if len(msg.MessageAttributes) > 0 {
+		input.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(msg.MessageAttributes))
+		for name, attr := range msg.MessageAttributes {
+			val := &sqs.MessageAttributeValue{DataType: aws.String(attr.DataType)}
+			if strings.HasPrefix(attr.DataType, "Binary") {
+				val.BinaryValue = attr.BinaryValue
+			} else {
+				val.StringValue = aws.String(attr.StringValue)
+			}
+			input.MessageAttributes[name] = val
+		}
+	}
+
+	out, err := s.sqsClient.SendMessageWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	msg.ID = aws.StringValue(out.MessageId)
+	return nil
+}
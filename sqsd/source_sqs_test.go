@@ -0,0 +1,85 @@
+package sqsd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeReceiveSQS records the ReceiveRequestAttemptId of ReceiveMessage calls, the calls in fail fail
+type fakeReceiveSQS struct {
+	sqsiface.SQSAPI
+
+	mu         sync.Mutex
+	fail       map[int]bool
+	attemptIDs []string
+}
+
+func (f *fakeReceiveSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attemptIDs = append(f.attemptIDs, aws.StringValue(input.ReceiveRequestAttemptId))
+	if f.fail[len(f.attemptIDs)] {
+		return nil, errors.New("connection reset by peer")
+	}
+	return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{{MessageId: aws.String("id"), ReceiptHandle: aws.String("handle")}}}, nil
+}
+
+func TestSQSSourceRetriesReceiveAttempt(t *testing.T) {
+	tests := []struct {
+		name     string
+		queueURL string
+		fail     map[int]bool
+		// same reports for every call after the first if it used the attempt id of the call before
+		same []bool
+	}{
+		{
+			name:     "attempt id is reused after a failure",
+			queueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/test.fifo",
+			fail:     map[int]bool{1: true, 2: true},
+			same:     []bool{true, true, false},
+		},
+		{
+			name:     "attempt id is new after a success",
+			queueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/test.fifo",
+			fail:     map[int]bool{2: true},
+			same:     []bool{false, true, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeReceiveSQS{fail: test.fail}
+			s := NewSQSSource(fake, test.queueURL, 30)
+			for i := 0; i <= len(test.same); i++ {
+				s.Receive(context.Background(), 10)
+			}
+
+			for i, same := range test.same {
+				prev, id := fake.attemptIDs[i], fake.attemptIDs[i+1]
+				if id == "" || (id == prev) != same {
+					t.Errorf("call %d used attempt id %q after %q, want the same id: %t", i+2, id, prev, same)
+				}
+			}
+		})
+	}
+}
+
+func TestSQSSourceStandardQueueHasNoAttemptID(t *testing.T) {
+	fake := &fakeReceiveSQS{fail: map[int]bool{1: true}}
+	s := NewSQSSource(fake, "https://sqs.eu-west-1.amazonaws.com/123456789012/test", 30)
+	for i := 0; i < 2; i++ {
+		s.Receive(context.Background(), 10)
+	}
+	for _, id := range fake.attemptIDs {
+		if id != "" {
+			t.Errorf("standard queue used attempt id %q", id)
+		}
+	}
+}
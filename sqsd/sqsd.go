@@ -1,102 +1,479 @@
 package sqsd
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/awsconfig"
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 // Client is the Daemon with all its options
 type Client struct {
-	SQSQueueURL       string
-	HTTPURL           string
-	ContentType       string
-	HTTPTimeout       int
+	SQSQueueURL string
+	HTTPURL     string
+	ContentType string
+	HTTPTimeout int
+	// ConnectTimeout is the time in seconds to wait for a connection to HTTPURL, 0 only applies HTTPTimeout
+	ConnectTimeout    int
 	VisibilityTimeout int
 	MaxConnections    int
-	Verbose           bool
 
+	// Logger receives the log entries of the daemon, when it is nil they are written as text to stderr.
+	// Verbose enables the debug entries of that default logger.
+	Logger  logging.Logger
+	Verbose bool
+
+	// Source is the queue messages are received from, when it is nil an SQSSource for SQSQueueURL is used
+	Source Source
+
+	// AWS are the settings of the SQS client
+	AWS awsconfig.Config
+
+	// Pollers is the number of concurrent long-polls, the default is enough to keep MaxConnections busy
+	Pollers int
+
+	// CronFile is the path to a cron.yaml file with periodic tasks, these are added to PeriodicTasks.
+	// Periodic tasks are sent to Source, which must implement Sender.
+	CronFile      string
+	PeriodicTasks []*PeriodicTask
+
+	// LeaderElector decides if this daemon queues the periodic tasks, when it is nil and LeaderQueueURL
+	// is set an SQSLeaderElector is used, otherwise this daemon always queues the periodic tasks
+	LeaderElector  LeaderElector
+	LeaderQueueURL string
+
+	// MaxRetries moves messages received more than MaxRetries times to DeadLetterQueue, 0 retries forever.
+	// When DeadLetterQueue is nil and DeadLetterQueueURL is set an SQSSource for that URL is used.
+	MaxRetries         int
+	DeadLetterQueue    Sender
+	DeadLetterQueueURL string
+
+	// ErrorVisibilityTimeout is the visibility timeout in seconds set after a failed delivery, 0 keeps VisibilityTimeout.
+	// ErrorVisibilityBackoff doubles this timeout for every time the message was received.
+	ErrorVisibilityTimeout int
+	ErrorVisibilityBackoff bool
+
+	// RetentionPeriod in seconds, older messages are not delivered but moved to
+	// DeadLetterQueue when set, or deleted otherwise. 0 delivers messages of any age.
+	RetentionPeriod int
+
+	// MaxJobDuration in seconds extends the visibility timeout of a message while it is being delivered,
+	// the HTTP request is cancelled after this duration. 0 does not extend the visibility timeout.
+	MaxJobDuration int
+
+	// SuccessCodes are the HTTP status codes of a successful delivery, when empty only 200 OK is a success.
+	// A response in PermanentFailureCodes is not retried, the message is moved to DeadLetterQueue when set or
+	// deleted otherwise. When RetryableCodes is set, responses with other codes are permanent failures as well.
+	SuccessCodes          StatusCodes
+	PermanentFailureCodes StatusCodes
+	RetryableCodes        StatusCodes
+
+	// BackpressureCodes are the HTTP status codes of responses that mean the endpoint is overloaded, like 429 and 503.
+	// The message is retried after the Retry-After of the response, or BackpressureDelay seconds when it has none,
+	// and receiving messages is paused for that time. 0 uses a delay of 10 seconds.
+	BackpressureCodes StatusCodes
+	BackpressureDelay int
+
+	// CircuitBreakerThreshold opens the circuit breaker after this many consecutive connection errors or 5xx responses,
+	// receiving messages is then paused. After CircuitBreakerTimeout seconds a single message is received as probe,
+	// when its delivery succeeds receiving continues, otherwise the circuit breaker opens again.
+	// 0 disables the circuit breaker, a CircuitBreakerTimeout of 0 uses 30 seconds.
+	CircuitBreakerThreshold int
+	CircuitBreakerTimeout   int
+
+	// HealthCheckURL or HealthCheckAddr is checked before receiving messages, a URL is healthy when a GET responds
+	// with a 2xx status code, an address like localhost:8080 when it accepts TCP connections. Run returns an error when
+	// the check does not succeed within HealthCheckTimeout seconds, 0 waits forever. With HealthCheckInterval the check
+	// runs every HealthCheckInterval seconds and receiving is paused while it fails, 0 only checks at start.
+	HealthCheckURL      string
+	HealthCheckAddr     string
+	HealthCheckTimeout  int
+	HealthCheckInterval int
+
+	// ShutdownTimeout is the time in seconds Run waits for in-flight deliveries when stopping, 0 waits until they are done
+	ShutdownTimeout int
+
+	loggerOnce   sync.Once
 	sqsClient    *sqs.SQS
 	httpClient   *http.Client
-	openRequests *counter
-	queueName    string
+	openRequests counter
+	slots        chan struct{}
+	metrics      *metrics
+	metricsOnce  sync.Once
+	pauser       pauser
+	backpressure backpressure
+	breaker      circuitBreaker
+	gateErr      chan error
+	health       health
+
+	// running is set by a successful Start and reset by Stop
+	running bool
+	// ctx is cancelled by Stop to end polling and scheduling, deliverCtx is cancelled to abort in-flight deliveries
+	ctx           context.Context
+	cancel        context.CancelFunc
+	deliverCtx    context.Context
+	deliverCancel context.CancelFunc
+	background    sync.WaitGroup
+	inFlight      sync.WaitGroup
 }
 
-// Start runs a new queue receiver from SQS
+// fifoHeaders are the headers with the system attributes of messages from FIFO queues
+var fifoHeaders = map[string]string{
+	"X-Aws-Sqsd-Message-Group-Id":         AttributeMessageGroupID,
+	"X-Aws-Sqsd-Message-Deduplication-Id": AttributeMessageDeduplicationID,
+	"X-Aws-Sqsd-Sequence-Number":          AttributeSequenceNumber,
+}
+
+const (
+	// releaseTimeout is the time Stop waits for aborted deliveries to make their messages visible again
+	releaseTimeout = 5 * time.Second
+
+	// maxReceiveMessages is the maximum number of messages SQS returns per ReceiveMessage call
+	maxReceiveMessages = 10
+)
+
+// Run starts the daemon and blocks until ctx is done, it then stops the daemon
+// and waits at most ShutdownTimeout seconds for in-flight deliveries.
+// context.DeadlineExceeded is returned when in-flight deliveries had to be aborted.
+// The daemon is also stopped when the endpoint does not become healthy within HealthCheckTimeout.
+func (c *Client) Run(ctx context.Context) error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+	case err := <-c.Failed():
+		c.Stop(context.Background())
+		return err
+	}
+
+	stopCtx := context.Background()
+	if c.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		stopCtx, cancel = context.WithTimeout(stopCtx, time.Duration(c.ShutdownTimeout)*time.Second)
+		defer cancel()
+	}
+	return c.Stop(stopCtx)
+}
+
+// Failed returns a channel that receives an error when the daemon cannot continue after Start, which is when
+// the endpoint does not become healthy within HealthCheckTimeout. The daemon should then be stopped, Run does so.
+func (c *Client) Failed() <-chan error {
+	return c.gateErr
+}
+
+// Stop stops receiving messages and waits until in-flight deliveries are done or ctx is done.
+// Deliveries still running when ctx is done are aborted and their messages are made visible again,
+// in that case the error of ctx is returned. Stop does nothing when the daemon is not running.
+func (c *Client) Stop(ctx context.Context) error {
+	if !c.running {
+		return nil
+	}
+	c.running = false
+
+	logging.Info(c.log(), "stopping, waiting for in-flight deliveries", logging.F("in_flight", c.openRequests.Get()))
+
+	c.health.drain()
+	c.cancel()
+	c.background.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.deliverCancel()
+		c.stopBreaker()
+		c.stopBackpressure()
+		c.closeSource()
+		logging.Debug(c.log(), "stopped")
+		return nil
+	case <-ctx.Done():
+	}
+
+	logging.Warn(c.log(), "aborting in-flight deliveries", logging.F("in_flight", c.openRequests.Get()))
+	c.deliverCancel()
+	c.stopBreaker()
+	c.stopBackpressure()
+
+	select {
+	case <-done:
+	case <-time.After(releaseTimeout):
+		logging.Warn(c.log(), "timeout releasing aborted messages, they will become visible after their visibility timeout")
+	}
+	c.closeSource()
+	return ctx.Err()
+}
+
+// closeSource flushes the pending acknowledgements of delivered messages
+func (c *Client) closeSource() {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if err := c.Source.Close(ctx); err != nil {
+		logging.Error(c.log(), "error closing queue", logging.F(logging.FieldQueue, c.Source.QueueName()), logging.Err(err))
+	}
+}
+
+// Start runs a new queue receiver, use Stop or Run to stop it gracefully
 func (c *Client) Start() error {
-	sess, err := session.NewSession()
-	if err != nil {
-		return fmt.Errorf("error creating AWS session (check environment variables): %s", err)
+	if c.MaxConnections < 1 {
+		return fmt.Errorf("max connections must be at least 1")
+	}
+	if c.MaxJobDuration > 0 && c.VisibilityTimeout < 2 {
+		return fmt.Errorf("a visibility timeout of at least 2 seconds is required when using max job duration")
+	}
+
+	if c.Source == nil {
+		if c.SQSQueueURL == "" {
+			return fmt.Errorf("an SQS queue URL is required")
+		}
+		sqsClient, err := c.sqs()
+		if err != nil {
+			return err
+		}
+		src := NewSQSSource(sqsClient, c.SQSQueueURL, c.VisibilityTimeout)
+		src.Logger = c.log()
+		c.Source = src
+	}
+	if n, ok := c.Source.(deleteNotifier); ok {
+		n.notifyDeleted(func(*Message) {
+			c.stats().deleted.Add(1)
+		})
+	}
+
+	if c.DeadLetterQueue == nil && c.DeadLetterQueueURL != "" {
+		sqsClient, err := c.sqs()
+		if err != nil {
+			return err
+		}
+		dlq := NewSQSSource(sqsClient, c.DeadLetterQueueURL, 0)
+		dlq.Logger = c.log()
+		c.DeadLetterQueue = dlq
+	}
+	if c.MaxRetries > 0 && c.DeadLetterQueue == nil {
+		return fmt.Errorf("a dead-letter queue is required when using max retries")
 	}
 
-	c.sqsClient = sqs.New(sess)
 	c.httpClient = &http.Client{Timeout: time.Duration(c.HTTPTimeout) * time.Second}
-	c.openRequests = new(counter)
+	if c.ConnectTimeout > 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(c.ConnectTimeout) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		c.httpClient.Transport = transport
+	}
+	c.slots = make(chan struct{}, c.MaxConnections)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.deliverCtx, c.deliverCancel = context.WithCancel(context.Background())
 
-	// determine queue name from url, we may need to get this from the SQS API
-	c.queueName = c.SQSQueueURL[strings.LastIndex(c.SQSQueueURL, "/")+1:]
+	if c.CronFile != "" {
+		tasks, err := ParseCronFile(c.CronFile)
+		if err != nil {
+			return err
+		}
+		c.PeriodicTasks = append(c.PeriodicTasks, tasks...)
+	}
+	for _, task := range c.PeriodicTasks {
+		if err := task.init(); err != nil {
+			return err
+		}
+	}
+
+	if len(c.PeriodicTasks) > 0 {
+		if _, ok := c.Source.(Sender); !ok {
+			return fmt.Errorf("periodic tasks require a queue that can send messages")
+		}
+		if c.LeaderElector == nil && c.LeaderQueueURL != "" {
+			if err := ValidateLeaderQueueURL(c.LeaderQueueURL); err != nil {
+				return err
+			}
+			sqsClient, err := c.sqs()
+			if err != nil {
+				return err
+			}
+			elector := NewSQSLeaderElector(sqsClient, c.LeaderQueueURL, defaultLeaderTTL)
+			elector.Logger = c.log()
+			c.LeaderElector = elector
+		}
+		if c.LeaderElector != nil {
+			c.goBackground(func() { c.LeaderElector.Campaign(c.ctx) })
+		}
+	}
+
+	c.health.start()
+
+	// receiving is paused until the endpoint is healthy
+	c.gateErr = make(chan error, 1)
+	if c.gateEnabled() {
+		c.pauser.set(gateReason, true)
+		logging.Info(c.log(), "waiting for endpoint to become healthy before receiving messages")
+		c.goBackground(c.gate)
+	}
 
-	go c.poller()
+	pollers := c.Pollers
+	if pollers <= 0 {
+		pollers = (c.MaxConnections + maxReceiveMessages - 1) / maxReceiveMessages
+	}
+	for i := 0; i < pollers; i++ {
+		c.goBackground(c.poller)
+	}
+
+	for _, task := range c.PeriodicTasks {
+		task := task
+		c.goBackground(func() { c.scheduler(task) })
+	}
+	c.running = true
 	return nil
 }
 
-func (c *Client) logf(msg string, args ...interface{}) {
-	if !c.Verbose {
-		return
+// sqs returns the SQS client, the AWS session is only created when SQS is used
+func (c *Client) sqs() (*sqs.SQS, error) {
+	if c.sqsClient != nil {
+		return c.sqsClient, nil
 	}
-	log.Printf(msg, args...)
+
+	sess, err := c.AWS.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	c.sqsClient = sqs.New(sess)
+	c.instrumentSQS(&c.sqsClient.Handlers)
+	return c.sqsClient, nil
 }
 
-func (c *Client) poller() {
+// goBackground runs f in a goroutine Stop waits for
+func (c *Client) goBackground(f func()) {
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		f()
+	}()
+}
 
-	c.logf("starting polling queue %s ...\n", c.SQSQueueURL)
+// log returns Logger, or the default logger when it is nil
+func (c *Client) log() logging.Logger {
+	c.loggerOnce.Do(func() {
+		if c.Logger == nil {
+			c.Logger = logging.Default(c.Verbose)
+		}
+	})
+	return c.Logger
+}
 
-	input := &sqs.ReceiveMessageInput{
-		QueueUrl:              aws.String(c.SQSQueueURL),
-		VisibilityTimeout:     aws.Int64(int64(c.VisibilityTimeout)),
-		MaxNumberOfMessages:   aws.Int64(1),
-		WaitTimeSeconds:       aws.Int64(20),
-		AttributeNames:        aws.StringSlice([]string{"ApproximateFirstReceiveTimestamp", "ApproximateReceiveCount"}),
-		MessageAttributeNames: aws.StringSlice([]string{"All"}),
-	}
+// messageLog returns the logger with the fields of msg
+func (c *Client) messageLog(msg *Message) logging.Logger {
+	return logging.With(c.log(),
+		logging.F(logging.FieldMessageID, msg.ID),
+		logging.F(logging.FieldQueue, c.Source.QueueName()),
+		logging.F(logging.FieldReceiveCount, msg.ReceiveCount()),
+	)
+}
+
+func (c *Client) poller() {
+
+	queueField := logging.F(logging.FieldQueue, c.Source.QueueName())
+	logging.Debug(c.log(), "starting polling queue", queueField)
+	c.health.addPoller(1)
+	defer c.health.addPoller(-1)
 
 	for {
 
-		out, err := c.sqsClient.ReceiveMessage(input)
-		if err != nil {
-			log.Printf("error receiving from SQS Queue: %s\n", err)
-			time.Sleep(2 * time.Second)
+		// wait while receiving is paused
+		paused, change := c.pauser.state()
+		if len(paused) > 0 {
+			select {
+			case <-change:
+				continue
+			case <-c.ctx.Done():
+				logging.Debug(c.log(), "stopped polling queue", queueField)
+				return
+			}
+		}
+
+		// while the circuit breaker is half-open a single message is received as probe,
+		// the probe pauses the other pollers so the change channel of that pause is used
+		max := maxReceiveMessages
+		probe := c.takeProbe()
+		if probe {
+			max = 1
+			_, change = c.pauser.state()
+		}
+
+		// only receive as many messages as there are free connections
+		n := c.acquireSlots(max)
+		if n == 0 {
+			logging.Debug(c.log(), "stopped polling queue", queueField)
+			return
+		}
+
+		// receiving can be paused while waiting for the slots, for example by a backpressure response
+		select {
+		case <-change:
+			c.releaseSlots(n)
+			if probe {
+				c.endProbe()
+			}
 			continue
+		default:
 		}
 
-		for _, msg := range out.Messages {
+		// the long poll is cancelled when receiving is paused
+		ctx, cancel := context.WithCancel(c.ctx)
+		go func() {
+			select {
+			case <-change:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
 
-			c.logf("received queue message with ID %s\n", aws.StringValue(msg.MessageId))
+		msgs, err := c.Source.Receive(ctx, n)
+		cancel()
+		if probe && (err != nil || len(msgs) == 0) {
+			c.endProbe()
+		}
+		if err != nil {
+			c.releaseSlots(n)
+			if ctx.Err() == nil {
+				c.health.received(err)
+				logging.Error(c.log(), "error receiving from queue", queueField, logging.Err(err))
+				sleepContext(c.ctx, 2*time.Second)
+			}
+			continue
+		}
+		c.health.received(nil)
+		c.releaseSlots(n - len(msgs))
+
+		c.stats().received.Add(len(msgs))
+		for _, group := range groupMessages(msgs) {
 
-			for c.openRequests.Get() >= c.MaxConnections {
-				time.Sleep(10 * time.Millisecond)
+			for _, msg := range group {
+				logging.Debug(c.messageLog(msg), "received queue message")
 			}
 
-			c.openRequests.Add(1)
-			go func() {
-				defer c.openRequests.Add(-1)
-				if err := c.sendHTTP(msg); err != nil {
-					log.Printf("error handling message %s: %s\n", aws.StringValue(msg.MessageId), err)
-				} else {
-					if err := c.deleteFromQueue(msg); err != nil {
-						log.Printf("error deleting message %s from queue: %s\n", aws.StringValue(msg.MessageId), err)
-					}
+			c.inFlight.Add(1)
+			go func(group []*Message) {
+				defer c.inFlight.Done()
+				c.handleGroup(group)
+				if probe {
+					c.endProbe()
 				}
-			}()
+			}(group)
 
 		}
 
@@ -104,59 +481,282 @@ func (c *Client) poller() {
 
 }
 
-func (c *Client) deleteFromQueue(msg *sqs.Message) error {
-	_, err := c.sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(c.SQSQueueURL),
-		ReceiptHandle: msg.ReceiptHandle,
-	})
-	if err != nil {
-		return err
+// acquireSlots blocks until at least one delivery slot is free and then takes up to max free slots.
+// It returns 0 when the client is stopping.
+func (c *Client) acquireSlots(max int) int {
+	if c.ctx.Err() != nil {
+		return 0
+	}
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		c.health.waitForSlots(1)
+		defer c.health.waitForSlots(-1)
+		select {
+		case c.slots <- struct{}{}:
+		case <-c.ctx.Done():
+			return 0
+		}
+	}
+
+	n := 1
+	for n < max {
+		select {
+		case c.slots <- struct{}{}:
+			n++
+		default:
+			return n
+		}
 	}
+	return n
+}
 
-	c.logf("message %s deleted from queue", aws.StringValue(msg.MessageId))
+func (c *Client) releaseSlots(n int) {
+	for i := 0; i < n; i++ {
+		<-c.slots
+	}
+}
+
+// release makes the message visible again so other daemons can receive it immediately
+func (c *Client) release(msg *Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if err := c.Source.Nack(ctx, msg, 0); err != nil {
+		logging.Error(c.messageLog(msg), "error releasing message", logging.Err(err))
+	}
+}
+
+// ack removes a delivered message from the queue
+func (c *Client) ack(msg *Message) error {
+	if err := c.Source.Ack(context.Background(), msg); err != nil {
+		return err
+	}
+	if _, ok := c.Source.(deleteNotifier); !ok {
+		c.stats().deleted.Add(1)
+	}
 	return nil
 }
 
-func (c *Client) sendHTTP(msg *sqs.Message) error {
-	req, err := http.NewRequest(http.MethodPost, c.HTTPURL, strings.NewReader(aws.StringValue(msg.Body)))
+// groupMessages splits received messages in groups that are delivered one at a time in order.
+// Messages of a FIFO queue with the same group id are one group, other messages are a group by themselves.
+func groupMessages(msgs []*Message) [][]*Message {
+	var groups [][]*Message
+	index := make(map[string]int)
+	for _, msg := range msgs {
+		id := msg.GroupID()
+		if i, ok := index[id]; ok && id != "" {
+			groups[i] = append(groups[i], msg)
+			continue
+		}
+		index[id] = len(groups)
+		groups = append(groups, []*Message{msg})
+	}
+	return groups
+}
+
+// handleGroup delivers the messages one at a time, each message holds a delivery slot until it is handled.
+// When a message is not delivered, or the daemon is stopping, the remaining messages are released,
+// so they are received again after it.
+func (c *Client) handleGroup(group []*Message) {
+	for i, msg := range group {
+		if i > 0 && c.ctx.Err() != nil {
+			c.releaseGroup(group[i:], "releasing message, the daemon is stopping")
+			return
+		}
+
+		c.openRequests.Add(1)
+		ok := c.handleMessage(msg)
+		c.openRequests.Add(-1)
+		c.releaseSlots(1)
+
+		if !ok {
+			c.releaseGroup(group[i+1:], "releasing message, an earlier message of its group was not delivered")
+			return
+		}
+	}
+}
+
+// releaseGroup releases the messages of a group that are not delivered and their delivery slots
+func (c *Client) releaseGroup(msgs []*Message, reason string) {
+	for _, msg := range msgs {
+		logging.Debug(c.messageLog(msg), reason)
+		c.release(msg)
+		c.releaseSlots(1)
+	}
+}
+
+// handleMessage delivers the message, it returns false when the message is still in the queue
+func (c *Client) handleMessage(msg *Message) bool {
+	if c.expired(msg) {
+		return c.discardExpired(msg)
+	}
+
+	if c.breakerIsOpen() {
+		logging.Debug(c.messageLog(msg), "releasing message, the circuit breaker is open")
+		c.release(msg)
+		return false
+	}
+
+	if c.MaxRetries > 0 && msg.ReceiveCount() > c.MaxRetries {
+		reason := fmt.Sprintf("received %d times", msg.ReceiveCount())
+		if err := c.moveToDeadLetterQueue(msg, reason); err != nil {
+			logging.Error(c.messageLog(msg), "error moving message to dead-letter queue", logging.Err(err))
+			return false
+		}
+		return true
+	}
+
+	err := c.deliver(msg)
+	c.recordDelivery(err)
 	if err != nil {
-		return fmt.Errorf("error creating HTTP request: %s", err)
+		c.stats().failed.Add(1)
+		if c.deliverCtx.Err() != nil {
+			logging.Warn(c.messageLog(msg), "delivery of message aborted")
+			c.release(msg)
+			return false
+		}
+		fields := []logging.Field{logging.Err(err)}
+		statusErr, ok := err.(*statusError)
+		if ok {
+			fields = append(fields, logging.F(logging.FieldStatus, statusErr.StatusCode))
+		}
+		if ok && c.isBackpressure(statusErr.StatusCode) {
+			delay := c.backpressureDelay(statusErr.RetryAfter)
+			logging.Warn(c.messageLog(msg), "endpoint is overloaded, retrying message later",
+				logging.F(logging.FieldStatus, statusErr.StatusCode), logging.F(logging.FieldDuration, delay))
+			c.pauseFor(delay)
+			if err := c.Source.Nack(context.Background(), msg, delay); err != nil {
+				logging.Error(c.messageLog(msg), "error changing visibility of message", logging.Err(err))
+			}
+			return false
+		}
+		logging.Error(c.messageLog(msg), "error handling message", fields...)
+		if ok && c.permanentFailure(statusErr.StatusCode) {
+			c.stats().rejected.Add(1)
+			return c.discard(msg, fmt.Sprintf("permanent failure, received HTTP response code %d", statusErr.StatusCode))
+		}
+		if c.ErrorVisibilityTimeout > 0 {
+			timeout := time.Duration(c.errorVisibilityTimeout(msg)) * time.Second
+			if err := c.Source.Nack(context.Background(), msg, timeout); err != nil {
+				logging.Error(c.messageLog(msg), "error changing visibility of message", logging.Err(err))
+			}
+		}
+		return false
+	}
+
+	c.stats().delivered.Add(1)
+	logging.Debug(c.messageLog(msg), "message delivered")
+	if err := c.ack(msg); err != nil {
+		logging.Error(c.messageLog(msg), "error deleting message", logging.Err(err))
+		return false
+	}
+	return true
+}
+
+// deliver sends the message to HTTPURL, with MaxJobDuration the visibility of the message is
+// extended while waiting for the response and the request is cancelled after MaxJobDuration
+func (c *Client) deliver(msg *Message) error {
+	if sent := msg.SentAt(); !sent.IsZero() {
+		c.stats().messageAge.observe("", time.Since(sent).Seconds())
+	}
+
+	if c.MaxJobDuration <= 0 {
+		return c.sendHTTP(c.deliverCtx, msg)
 	}
 
-	// ignore time errors for now, that will just pass an empty time value
-	firstReceivedTS, _ := strconv.ParseInt(aws.StringValue(msg.Attributes["ApproximateFirstReceiveTimestamp"]), 10, 64)
+	ctx, cancel := context.WithTimeout(c.deliverCtx, time.Duration(c.MaxJobDuration)*time.Second)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		c.heartbeat(ctx, msg)
+	}()
+
+	err := c.sendHTTP(ctx, msg)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("job exceeded the maximum duration of %d seconds: %s", c.MaxJobDuration, err)
+	}
+
+	cancel()
+	<-heartbeatDone
+	return err
+}
+
+func (c *Client) sendHTTP(ctx context.Context, msg *Message) error {
+	targetURL := c.HTTPURL
+
+	// periodic tasks are posted to the path of the task
+	taskName, isTask := msg.MessageAttributes[attrTaskName]
+	taskPath := msg.MessageAttributes[attrTaskPath]
+	if isTask {
+		if taskPath == nil {
+			return fmt.Errorf("periodic task %s has no path", taskName.StringValue)
+		}
+		var err error
+		targetURL, err = c.taskURL(taskPath.StringValue)
+		if err != nil {
+			return fmt.Errorf("error creating URL for periodic task %s: %s", taskName.StringValue, err)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, targetURL, strings.NewReader(msg.Body))
+	if err != nil {
+		return fmt.Errorf("error creating HTTP request: %s", err)
+	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("User-Agent", "aws-sqsd")
 	req.Header.Set("Content-Type", c.ContentType)
-	req.Header.Set("X-Aws-Sqsd-Msgid", aws.StringValue(msg.MessageId))
-	req.Header.Set("X-Aws-Sqsd-Queue", c.queueName)
-	req.Header.Set("X-Aws-Sqsd-Receive-Count", aws.StringValue(msg.Attributes["ApproximateReceiveCount"]))
-	req.Header.Set("X-Aws-Sqsd-First-Received-At", time.Unix(0, firstReceivedTS*1000000).Format(time.RFC3339))
+	req.Header.Set("X-Aws-Sqsd-Msgid", msg.ID)
+	req.Header.Set("X-Aws-Sqsd-Queue", c.Source.QueueName())
+	req.Header.Set("X-Aws-Sqsd-Receive-Count", msg.Attributes[AttributeApproximateReceiveCount])
+	req.Header.Set("X-Aws-Sqsd-First-Received-At", msg.FirstReceivedAt().Format(time.RFC3339))
+
+	for header, attr := range fifoHeaders {
+		if v := msg.Attributes[attr]; v != "" {
+			req.Header.Set(header, v)
+		}
+	}
 
-	for attrName, attrVal := range msg.MessageAttributes {
-		if aws.StringValue(attrVal.DataType) == "Binary" {
-			continue
+	if isTask {
+		req.Header.Set("X-Aws-Sqsd-Taskname", taskName.StringValue)
+		if scheduledAt := msg.MessageAttributes[attrScheduledTime]; scheduledAt != nil {
+			req.Header.Set("X-Aws-Sqsd-Scheduled-At", scheduledAt.StringValue)
 		}
-		req.Header.Set("X-Aws-Sqsd-Attr-"+attrName, aws.StringValue(attrVal.StringValue))
+		req.Header.Set("X-Aws-Sqsd-Path", taskPath.StringValue)
 	}
 
-	if c.Verbose {
-		reqLog, _ := httputil.DumpRequestOut(req, true)
-		c.logf(string(reqLog))
+	attrs := msg.MessageAttributes
+	if isTask {
+		attrs = make(map[string]*MessageAttribute, len(msg.MessageAttributes))
+		for name, attr := range msg.MessageAttributes {
+			if !strings.HasPrefix(name, "beanstalk.sqsd.") {
+				attrs[name] = attr
+			}
+		}
+	}
+	if err := setAttributeHeaders(req.Header, attrs); err != nil {
+		return fmt.Errorf("error encoding message attributes: %s", err)
 	}
 
+	msgLog := c.messageLog(msg)
+	logging.Debug(msgLog, "delivering message", logging.F("url", targetURL), logging.F("body_size", len(msg.Body)))
+
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
+	duration := time.Since(start)
 	if err != nil {
+		c.stats().deliveryDuration.observe("error", duration.Seconds())
 		return err
 	}
+	c.stats().deliveryDuration.observe(strconv.Itoa(resp.StatusCode), duration.Seconds())
 	defer resp.Body.Close()
 
-	if c.Verbose {
-		respLog, _ := httputil.DumpResponse(resp, true)
-		c.logf(string(respLog))
-	}
+	logging.Debug(msgLog, "received HTTP response",
+		logging.F(logging.FieldStatus, resp.StatusCode),
+		logging.F(logging.FieldDuration, duration),
+	)
 
-	if resp.StatusCode == http.StatusOK {
+	if c.success(resp.StatusCode) {
 		return nil
 	}
 
@@ -165,5 +765,39 @@ func (c *Client) sendHTTP(msg *sqs.Message) error {
 		return fmt.Errorf("error reading response body: %s", err)
 	}
 
-	return fmt.Errorf("received non 200 HTTP response code %s: %s", resp.Status, string(b))
+	return &statusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(b),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// success reports whether a response with the status code is a successful delivery
+func (c *Client) success(code int) bool {
+	if len(c.SuccessCodes) == 0 {
+		return code == http.StatusOK
+	}
+	return c.SuccessCodes.Contains(code)
+}
+
+// permanentFailure reports whether a message that got a response with the status code should not be retried
+func (c *Client) permanentFailure(code int) bool {
+	if c.PermanentFailureCodes.Contains(code) {
+		return true
+	}
+	return len(c.RetryableCodes) > 0 && !c.RetryableCodes.Contains(code)
+}
+
+// statusError is the error of a delivery that got a response with a status code that is not a success
+type statusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	// RetryAfter is the Retry-After of the response, 0 when it has none
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("received unsuccessful HTTP response code %s: %s", e.Status, e.Body)
 }
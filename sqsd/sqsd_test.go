@@ -0,0 +1,597 @@
+package sqsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+// testEndpoint is a worker endpoint, respond handles the n-th request
+type testEndpoint struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func newTestEndpoint(respond func(n int, w http.ResponseWriter, r *http.Request)) *testEndpoint {
+	e := new(testEndpoint)
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		e.times = append(e.times, time.Now())
+		n := len(e.times)
+		e.mu.Unlock()
+		respond(n, w, r)
+	}))
+	return e
+}
+
+func (e *testEndpoint) count() int {
+	return len(e.requestTimes())
+}
+
+// requestTimes returns the times the requests were received
+func (e *testEndpoint) requestTimes() []time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]time.Time(nil), e.times...)
+}
+
+// respondWith returns a respond function for newTestEndpoint that always responds with code
+func respondWith(code int) func(int, http.ResponseWriter, *http.Request) {
+	return func(n int, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}
+}
+
+// newTestClient returns a client delivering the messages of a MemorySource to the endpoint
+func newTestClient(e *testEndpoint) (*Client, *MemorySource) {
+	src := NewMemorySource("test", 30*time.Second)
+	c := &Client{
+		HTTPURL:        e.URL,
+		HTTPTimeout:    10,
+		MaxConnections: 2,
+		Source:         src,
+		Logger:         logging.Discard,
+	}
+	return c, src
+}
+
+func send(t *testing.T, s Sender, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if err := s.Send(context.Background(), &Message{Body: body}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitFor fails the test when cond does not become true within 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func queueLen(s *MemorySource) int {
+	n, _ := s.Len()
+	return n
+}
+
+func stopClient(t *testing.T, c *Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientDelivers(t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	bodies := make(map[string]string)
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies[r.Header.Get("X-Aws-Sqsd-Msgid")] = string(b)
+		if r.Header.Get("X-Aws-Sqsd-Queue") != "test" || r.Header.Get("Content-Type") != "text/plain" || r.Header.Get("X-Aws-Sqsd-Receive-Count") != "1" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.MaxConnections = 3
+	c.ContentType = "text/plain"
+
+	want := make(map[string]string)
+	for i := 0; i < 25; i++ {
+		msg := &Message{Body: fmt.Sprint("message ", i)}
+		if err := src.Send(context.Background(), msg, 0); err != nil {
+			t.Fatal(err)
+		}
+		want[msg.ID] = msg.Body
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the messages to be delivered", func() bool { return queueLen(src) == 0 })
+	stopClient(t, c)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("delivered %v, want %v", bodies, want)
+	}
+	if maxActive > c.MaxConnections || maxActive < 2 {
+		t.Errorf("%d concurrent deliveries, want more than 1 and at most %d", maxActive, c.MaxConnections)
+	}
+	m := c.stats()
+	if m.received.Get() != 25 || m.delivered.Get() != 25 || m.deleted.Get() != 25 || m.failed.Get() != 0 {
+		t.Errorf("received %d, delivered %d, deleted %d and failed %d, want 25, 25, 25 and 0",
+			m.received.Get(), m.delivered.Get(), m.deleted.Get(), m.failed.Get())
+	}
+}
+
+func TestClientPermanentFailure(t *testing.T) {
+	for _, withDLQ := range []bool{false, true} {
+		e := newTestEndpoint(respondWith(http.StatusUnprocessableEntity))
+		defer e.Close()
+		c, src := newTestClient(e)
+		c.PermanentFailureCodes, _ = ParseStatusCodes("4xx")
+		dlq := NewMemorySource("dlq", 30*time.Second)
+		if withDLQ {
+			c.DeadLetterQueue = dlq
+		}
+
+		send(t, src, "a", "b")
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the messages to be removed from the queue", func() bool { return queueLen(src) == 0 })
+		stopClient(t, c)
+
+		if n := e.count(); n != 2 {
+			t.Errorf("DLQ %v: %d deliveries, want 2", withDLQ, n)
+		}
+		wantDead := 0
+		if withDLQ {
+			wantDead = 2
+		}
+		if n := queueLen(dlq); n != wantDead {
+			t.Errorf("DLQ %v: %d messages in the dead-letter queue, want %d", withDLQ, n, wantDead)
+		}
+		m := c.stats()
+		if rejected, deleted := m.rejected.Get(), m.deleted.Get(); rejected != 2 || deleted != 2 {
+			t.Errorf("DLQ %v: %d rejected and %d deleted, want 2", withDLQ, rejected, deleted)
+		}
+	}
+}
+
+// failingAckSource is a MemorySource that can not delete messages
+type failingAckSource struct {
+	*MemorySource
+}
+
+func (s failingAckSource) Ack(ctx context.Context, msg *Message) error {
+	return errors.New("access denied")
+}
+
+func TestDiscardAckError(t *testing.T) {
+	src := failingAckSource{NewMemorySource("test", 30*time.Second)}
+	dlq := NewMemorySource("dlq", 30*time.Second)
+
+	for _, dead := range []Sender{nil, dlq} {
+		c := &Client{Source: src, Logger: logging.Discard}
+		if dead != nil {
+			c.DeadLetterQueue = dead
+		}
+		if c.discard(&Message{ID: "1", ReceiptHandle: "rh-1"}, "test") {
+			t.Errorf("DLQ %v: discard reported the message as removed from the queue", dead != nil)
+		}
+		if n := c.stats().deleted.Get(); n != 0 {
+			t.Errorf("DLQ %v: %d messages counted as deleted", dead != nil, n)
+		}
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	// the endpoint is down for the first 3 requests
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		if n <= 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	defer e.Close()
+	c, src := newTestClient(e)
+	src.VisibilityTimeout = 100 * time.Millisecond
+	c.MaxConnections = 1
+	c.CircuitBreakerThreshold = 2
+	c.CircuitBreakerTimeout = 1
+
+	send(t, src, "a", "b", "c")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the messages to be delivered", func() bool { return queueLen(src) == 0 })
+	stopClient(t, c)
+
+	// 2 failures open the circuit breaker, the first probe fails and opens it again, the second one succeeds
+	times := e.requestTimes()
+	if len(times) != 6 {
+		t.Fatalf("%d requests, want 6", len(times))
+	}
+	for _, i := range []int{2, 3} {
+		if d := times[i].Sub(times[i-1]); d < time.Second {
+			t.Errorf("request %d was sent %s after the previous one while the circuit breaker was open", i+1, d)
+		}
+	}
+
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	if c.breaker.state != breakerClosed || c.breaker.timer != nil {
+		t.Errorf("circuit breaker is in state %d with timer %v after the probe succeeded", c.breaker.state, c.breaker.timer)
+	}
+}
+
+func TestStopStopsCircuitBreakerTimer(t *testing.T) {
+	e := newTestEndpoint(respondWith(http.StatusBadGateway))
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.CircuitBreakerThreshold = 1
+	c.CircuitBreakerTimeout = 60
+
+	send(t, src, "a")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the circuit breaker to open", c.breakerIsOpen)
+	stopClient(t, c)
+
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	if c.breaker.timer != nil {
+		t.Error("the timer of the circuit breaker is not stopped")
+	}
+}
+
+func TestClientMaxRetries(t *testing.T) {
+	e := newTestEndpoint(respondWith(http.StatusInternalServerError))
+	defer e.Close()
+	c, src := newTestClient(e)
+	src.VisibilityTimeout = 50 * time.Millisecond
+	dlq := NewMemorySource("dlq", 30*time.Second)
+	c.MaxRetries = 2
+	c.DeadLetterQueue = dlq
+
+	send(t, src, "retried")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the message to be moved", func() bool { return queueLen(src) == 0 })
+	stopClient(t, c)
+
+	if n := e.count(); n != c.MaxRetries {
+		t.Errorf("%d deliveries, want %d", n, c.MaxRetries)
+	}
+	msgs, _ := dlq.Receive(context.Background(), maxReceiveMessages)
+	if len(msgs) != 1 || msgs[0].Body != "retried" {
+		t.Errorf("got %v in the dead-letter queue, want the retried message", msgs)
+	}
+}
+
+func TestClientMaxRetriesRequiresDeadLetterQueue(t *testing.T) {
+	c := &Client{MaxConnections: 1, MaxRetries: 1, Source: NewMemorySource("test", time.Second), Logger: logging.Discard}
+	if err := c.Start(); err == nil {
+		t.Error("expected an error starting with max retries and no dead-letter queue")
+	}
+}
+
+func TestClientStopWaitsForDeliveries(t *testing.T) {
+	release := make(chan struct{})
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer e.Close()
+	c, src := newTestClient(e)
+
+	send(t, src, "slow")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery to start", func() bool { return e.count() == 1 })
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- c.Stop(context.Background())
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned %v before the delivery was done", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return after the delivery was done")
+	}
+	if n := queueLen(src); n != 0 {
+		t.Errorf("%d messages in the queue, want the delivered message to be deleted", n)
+	}
+}
+
+func TestClientStopAbortsDeliveries(t *testing.T) {
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		// the closed connection is only noticed after reading the body
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	})
+	defer e.Close()
+	c, src := newTestClient(e)
+
+	send(t, src, "stuck")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery to start", func() bool { return e.count() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Stop returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the aborted message is visible again for other daemons
+	if total, inFlight := src.Len(); total != 1 || inFlight != 0 {
+		t.Errorf("%d messages in the queue of which %d in flight, want 1 visible message", total, inFlight)
+	}
+	if n := c.stats().deleted.Get(); n != 0 {
+		t.Errorf("%d messages deleted", n)
+	}
+}
+
+func TestClientRunStopsWhenContextIsDone(t *testing.T) {
+	e := newTestEndpoint(respondWith(http.StatusOK))
+	defer e.Close()
+	c, src := newTestClient(e)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	send(t, src, "a")
+	waitFor(t, "the message to be delivered", func() bool { return queueLen(src) == 0 })
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after its context was done")
+	}
+
+	// no messages are received after stopping
+	send(t, src, "b")
+	time.Sleep(100 * time.Millisecond)
+	if n := e.count(); n != 1 {
+		t.Errorf("%d deliveries, want 1", n)
+	}
+}
+
+func TestGroupMessages(t *testing.T) {
+	msg := func(id, group string) *Message {
+		m := &Message{ID: id}
+		if group != "" {
+			m.Attributes = map[string]string{AttributeMessageGroupID: group}
+		}
+		return m
+	}
+	ids := func(groups [][]*Message) [][]string {
+		var s [][]string
+		for _, g := range groups {
+			var group []string
+			for _, m := range g {
+				group = append(group, m.ID)
+			}
+			s = append(s, group)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name string
+		msgs []*Message
+		want [][]string
+	}{
+		{
+			name: "no messages",
+		},
+		{
+			name: "same group in receive order",
+			msgs: []*Message{msg("a1", "a"), msg("b1", "b"), msg("a2", "a"), msg("a3", "a"), msg("b2", "b")},
+			want: [][]string{{"a1", "a2", "a3"}, {"b1", "b2"}},
+		},
+		{
+			name: "messages without group",
+			msgs: []*Message{msg("1", ""), msg("2", ""), msg("3", "")},
+			want: [][]string{{"1"}, {"2"}, {"3"}},
+		},
+		{
+			name: "mixed",
+			msgs: []*Message{msg("1", ""), msg("a1", "a"), msg("2", ""), msg("a2", "a")},
+			want: [][]string{{"1"}, {"a1", "a2"}, {"2"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ids(groupMessages(test.msgs)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got groups %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientReleasesGroupAfterFailure(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		delivered = append(delivered, string(b))
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.MaxConnections = 3
+	src.FIFO = true
+
+	for i := 1; i <= 3; i++ {
+		msg := &Message{
+			Body: fmt.Sprint("message ", i),
+			Attributes: map[string]string{
+				AttributeMessageGroupID:         "group",
+				AttributeMessageDeduplicationID: fmt.Sprint(i),
+			},
+		}
+		if err := src.Send(context.Background(), msg, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopClient(t, c)
+
+	// the failed message stays invisible, the later messages are visible again but blocked behind it
+	waitFor(t, "the later messages to be released", func() bool {
+		total, inFlight := src.Len()
+		return e.count() == 1 && total == 3 && inFlight == 1
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(delivered, []string{"message 1"}) {
+		t.Errorf("delivered %v, want only the first message of the group", delivered)
+	}
+	if n := c.stats().received.Get(); n != 3 {
+		t.Errorf("received %d messages, want 3", n)
+	}
+}
+
+func TestClientStopWhenNotRunning(t *testing.T) {
+	e := newTestEndpoint(respondWith(http.StatusOK))
+	defer e.Close()
+
+	c, _ := newTestClient(e)
+	if err := c.Stop(context.Background()); err != nil {
+		t.Errorf("Stop before Start returned %v", err)
+	}
+
+	c, _ = newTestClient(e)
+	c.MaxConnections = 0
+	if err := c.Start(); err == nil {
+		t.Fatal("expected Start to fail without connections")
+	}
+	if err := c.Stop(context.Background()); err != nil {
+		t.Errorf("Stop after a failed Start returned %v", err)
+	}
+
+	c, _ = newTestClient(e)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stopClient(t, c)
+	if err := c.Stop(context.Background()); err != nil {
+		t.Errorf("second Stop returned %v", err)
+	}
+}
+
+func TestClientStopReleasesGroup(t *testing.T) {
+	release := make(chan struct{})
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer e.Close()
+	c, src := newTestClient(e)
+	c.MaxConnections = 3
+	src.FIFO = true
+
+	for i := 1; i <= 3; i++ {
+		msg := &Message{
+			Body: fmt.Sprint("message ", i),
+			Attributes: map[string]string{
+				AttributeMessageGroupID:         "group",
+				AttributeMessageDeduplicationID: fmt.Sprint(i),
+			},
+		}
+		if err := src.Send(context.Background(), msg, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery to start", func() bool { return e.count() == 1 })
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- c.Stop(context.Background())
+	}()
+	waitFor(t, "the daemon to stop receiving", func() bool { return c.ctx.Err() != nil })
+	close(release)
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return after the delivery was done")
+	}
+
+	// the delivered message is deleted, the rest of its group is visible again for other daemons
+	if n := e.count(); n != 1 {
+		t.Errorf("%d deliveries, want 1", n)
+	}
+	if total, inFlight := src.Len(); total != 2 || inFlight != 0 {
+		t.Errorf("%d messages in the queue of which %d in flight, want 2 visible messages", total, inFlight)
+	}
+}
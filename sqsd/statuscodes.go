@@ -0,0 +1,74 @@
+package sqsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusCodes is a set of HTTP status codes, like 200,201-204 or 2xx
+type StatusCodes []statusRange
+
+type statusRange struct {
+	from, to int
+}
+
+// ParseStatusCodes parses a comma separated list of status codes, ranges like 201-204 and classes like 4xx
+func ParseStatusCodes(s string) (StatusCodes, error) {
+	var codes StatusCodes
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var r statusRange
+		var err error
+		lower := strings.ToLower(part)
+		switch {
+		case len(lower) == 3 && strings.HasSuffix(lower, "xx"):
+			var class int
+			class, err = strconv.Atoi(lower[:1])
+			r = statusRange{from: class * 100, to: class*100 + 99}
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			if r.from, err = strconv.Atoi(strings.TrimSpace(bounds[0])); err == nil {
+				r.to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			}
+		default:
+			r.from, err = strconv.Atoi(part)
+			r.to = r.from
+		}
+
+		if err != nil || r.from < 100 || r.to > 599 || r.from > r.to {
+			return nil, fmt.Errorf("invalid status code %q, use a code, range or class between 100 and 599 like 200, 201-204 or 2xx", part)
+		}
+		codes = append(codes, r)
+	}
+	return codes, nil
+}
+
+// Contains reports whether code is in the set
+func (s StatusCodes) Contains(code int) bool {
+	for _, r := range s {
+		if code >= r.from && code <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s StatusCodes) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		switch {
+		case r.from == r.to:
+			parts[i] = strconv.Itoa(r.from)
+		case r.from%100 == 0 && r.to == r.from+99:
+			parts[i] = strconv.Itoa(r.from/100) + "xx"
+		default:
+			parts[i] = strconv.Itoa(r.from) + "-" + strconv.Itoa(r.to)
+		}
+	}
+	return strings.Join(parts, ",")
+}
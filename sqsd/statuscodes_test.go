@@ -0,0 +1,46 @@
+package sqsd
+
+import "testing"
+
+func TestParseStatusCodes(t *testing.T) {
+	tests := []struct {
+		in       string
+		want     string
+		contains []int
+		excludes []int
+	}{
+		{in: "200", want: "200", contains: []int{200}, excludes: []int{199, 201}},
+		{in: "200, 201-204 ,2xx", want: "200,201-204,2xx", contains: []int{200, 203, 299}, excludes: []int{300}},
+		{in: "4XX", want: "4xx", contains: []int{400, 422, 499}, excludes: []int{399, 500}},
+		{in: "410-410", want: "410", contains: []int{410}, excludes: []int{411}},
+		{in: "100-599", want: "100-599", contains: []int{100, 599}},
+		{in: ",,", want: "", excludes: []int{200}},
+	}
+	for _, test := range tests {
+		codes, err := ParseStatusCodes(test.in)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.in, err)
+			continue
+		}
+		if got := codes.String(); got != test.want {
+			t.Errorf("%q is parsed as %q, want %q", test.in, got, test.want)
+		}
+		for _, code := range test.contains {
+			if !codes.Contains(code) {
+				t.Errorf("%q does not contain %d", test.in, code)
+			}
+		}
+		for _, code := range test.excludes {
+			if codes.Contains(code) {
+				t.Errorf("%q contains %d", test.in, code)
+			}
+		}
+	}
+
+	invalid := []string{"99", "600", "0xx", "6xx", "axx", "204-201", "200-", "-200", "2x", "ok"}
+	for _, in := range invalid {
+		if codes, err := ParseStatusCodes(in); err == nil {
+			t.Errorf("expected an error parsing %q, got %s", in, codes)
+		}
+	}
+}
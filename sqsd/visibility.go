@@ -0,0 +1,40 @@
+package sqsd
+
+import (
+	"context"
+	"time"
+
+	"github.com/SebastiaanKlippert/aws-beanstalk-sqs-daemon/logging"
+)
+
+// maxVisibilityTimeout is the maximum visibility timeout SQS allows (12 hours)
+const maxVisibilityTimeout = 43200
+
+// errorVisibilityTimeout returns the visibility timeout in seconds for a message that failed delivery.
+// With ErrorVisibilityBackoff the timeout doubles for every receive: timeout * 2^(receive count - 1).
+func (c *Client) errorVisibilityTimeout(msg *Message) int {
+	timeout := c.ErrorVisibilityTimeout
+	if c.ErrorVisibilityBackoff {
+		for n := msg.ReceiveCount(); n > 1 && timeout < maxVisibilityTimeout; n-- {
+			timeout *= 2
+		}
+	}
+	if timeout > maxVisibilityTimeout {
+		timeout = maxVisibilityTimeout
+	}
+	return timeout
+}
+
+// heartbeat extends the visibility timeout of the message every half VisibilityTimeout until ctx is done
+func (c *Client) heartbeat(ctx context.Context, msg *Message) {
+	timeout := time.Duration(c.VisibilityTimeout) * time.Second
+	for sleepContext(ctx, timeout/2) {
+		if err := c.Source.Extend(ctx, msg, timeout); err != nil {
+			if ctx.Err() == nil {
+				logging.Error(c.messageLog(msg), "error extending visibility of message", logging.Err(err))
+			}
+			continue
+		}
+		logging.Debug(c.messageLog(msg), "visibility timeout of message extended", logging.F(logging.FieldDuration, timeout))
+	}
+}
@@ -0,0 +1,125 @@
+package sqsd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestErrorVisibilityTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      int
+		backoff      bool
+		receiveCount int
+		want         int
+	}{
+		{name: "without backoff", timeout: 30, receiveCount: 5, want: 30},
+		{name: "first receive", timeout: 30, backoff: true, receiveCount: 1, want: 30},
+		{name: "second receive", timeout: 30, backoff: true, receiveCount: 2, want: 60},
+		{name: "fifth receive", timeout: 30, backoff: true, receiveCount: 5, want: 480},
+		{name: "unknown receive count", timeout: 30, backoff: true, want: 30},
+		{name: "capped at 12 hours", timeout: 30, backoff: true, receiveCount: 20, want: maxVisibilityTimeout},
+		{name: "many receives", timeout: 30, backoff: true, receiveCount: 100000, want: maxVisibilityTimeout},
+		{name: "base over 12 hours", timeout: 50000, want: maxVisibilityTimeout},
+		{name: "zero base", timeout: 0, backoff: true, receiveCount: 10, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{ErrorVisibilityTimeout: test.timeout, ErrorVisibilityBackoff: test.backoff}
+			msg := &Message{Attributes: map[string]string{}}
+			if test.receiveCount > 0 {
+				msg.Attributes[AttributeApproximateReceiveCount] = strconv.Itoa(test.receiveCount)
+			}
+			if got := c.errorVisibilityTimeout(msg); got != test.want {
+				t.Errorf("got %d seconds, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// extendSource records the Extend calls of a MemorySource
+type extendSource struct {
+	*MemorySource
+
+	mu      sync.Mutex
+	extends []time.Time
+}
+
+func (s *extendSource) Extend(ctx context.Context, msg *Message, d time.Duration) error {
+	s.mu.Lock()
+	s.extends = append(s.extends, time.Now())
+	s.mu.Unlock()
+	return s.MemorySource.Extend(ctx, msg, d)
+}
+
+func (s *extendSource) extendTimes() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.extends...)
+}
+
+func TestClientMaxJobDuration(t *testing.T) {
+	aborted := make(chan time.Time, 1)
+	e := newTestEndpoint(func(n int, w http.ResponseWriter, r *http.Request) {
+		if n > 1 {
+			return
+		}
+		// the closed connection is only noticed after reading the body
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+		aborted <- time.Now()
+	})
+	defer e.Close()
+	c, mem := newTestClient(e)
+	mem.VisibilityTimeout = 3 * time.Second
+	src := &extendSource{MemorySource: mem}
+	c.Source = src
+	c.VisibilityTimeout = 3
+	c.MaxJobDuration = 4
+
+	send(t, mem, "slow")
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopClient(t, c)
+	waitFor(t, "the delivery to start", func() bool { return e.count() == 1 })
+	started := e.requestTimes()[0]
+
+	var abortedAt time.Time
+	select {
+	case abortedAt = <-aborted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the delivery was not aborted")
+	}
+	if d := abortedAt.Sub(started); d < 3900*time.Millisecond || d > 5*time.Second {
+		t.Errorf("delivery aborted after %s, want 4s", d)
+	}
+
+	// the visibility is extended every VisibilityTimeout/2 while the delivery runs, and not after it was aborted
+	extends := src.extendTimes()
+	if len(extends) != 2 {
+		t.Fatalf("visibility extended %d times, want 2", len(extends))
+	}
+	for i, at := range extends {
+		want := time.Duration(i+1) * 1500 * time.Millisecond
+		if d := at.Sub(started); d < want-100*time.Millisecond || d > want+300*time.Millisecond {
+			t.Errorf("extension %d after %s, want %s", i+1, d, want)
+		}
+	}
+
+	// the aborted message becomes visible again after the visibility timeout and is delivered again
+	waitFor(t, "the message to be delivered again", func() bool { return queueLen(mem) == 0 })
+	times := e.requestTimes()
+	if d := times[1].Sub(extends[1]); d > 3500*time.Millisecond {
+		t.Errorf("message delivered again %s after the last extension, want at most the visibility timeout", d)
+	}
+	if n := len(src.extendTimes()); n != 2 {
+		t.Errorf("visibility extended %d times, want 2", n)
+	}
+}